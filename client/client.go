@@ -0,0 +1,733 @@
+package client
+
+import (
+	"net"
+	"context"
+	"io"
+	"sync"
+	"errors"
+	"bufio"
+	"net/http"
+	"strconv"
+	"fmt"
+	"time"
+	"crypto/tls"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/phachon/kitten/protocol"
+	"github.com/phachon/kitten/server"
+)
+
+var ErrShutdown = errors.New("connection is shut down")
+
+// ErrConnLost is returned to the pending calls when the connection of a client
+// with Redial is lost, they are not sent again
+var ErrConnLost = errors.New("rpc: connection lost")
+
+// ErrTimeout is returned by a call not answered within the client CallTimeout
+var ErrTimeout = errors.New("rpc: call timeout")
+
+// max backoff between the redial attempts
+const Max_Backoff = 10 * time.Second
+
+// ServerError represents an error that has been returned from the remote side of the RPC connection
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+// Call represents an active RPC
+type Call struct {
+	// the name of the service and method to call
+	Method string
+	// the argument to the function
+	Args interface{}
+	// the reply from the function
+	Reply interface{}
+	// after completion, the error status
+	Error error
+	// receives *Call when Go is complete
+	Done chan *Call
+	// after completion, the meta data of the response, nil if no response
+	Meta map[string]string
+
+	// context of CallContext, the deadline is sent in the request meta
+	ctx context.Context
+	// seq of the sent request
+	seq uint64
+}
+
+// is the response of the call, a response without the echoed method is of the seq only
+func (call *Call) matches(res *protocol.Message) bool {
+	method, ok := res.GetMeta(protocol.Meta_Method)
+	return !ok || method == call.Method
+}
+
+// call is complete
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+		// ok
+	default:
+		// we don't want to block here, it is the caller's responsibility to make
+		// sure the channel has enough buffer space
+	}
+}
+
+// Client kitten rpc client, a client may be used by multiple goroutines simultaneously
+type Client struct {
+	conn *protocol.Conn
+
+	// serialize type of the request payload, default Serialize_Json
+	SerializeType byte
+	// compress type of the request payload, default Compress_Type_None
+	CompressType byte
+	// request payload shorter than it is written uncompressed, default protocol.Default_Compress_Threshold
+	CompressThreshold int
+	// gzip level of the gzip compressed requests, it replaces the level of the registered protocol.GzipCompressor.
+	// default gzip.DefaultCompression, 0 is gzip.NoCompression
+	GzipLevel int
+	// compress types of the responses the client can uncompress, sent in every request.
+	// nil means only CompressType
+	AcceptCompress []byte
+	// hmac key shared with the server, set before the first call, nil means no hmac.
+	// the NewClientVersion handshake has no hmac
+	AuthKey []byte
+	// byte order of the seq and lengths of the requests and responses, set before the first call,
+	// nil means binary.BigEndian. the NewClientVersion handshake is big endian
+	ByteOrder binary.ByteOrder
+	// magic number of the requests and responses, set before the first call, 0 means protocol.MagicNumber.
+	// the NewClientVersion handshake has the default magic number
+	MagicNumber byte
+	// redial a lost connection at the next call, nil means no reconnection. set before the first call,
+	// the redialed connection has no NewClientVersion handshake
+	Redial func() (net.Conn, error)
+	// max redial attempts of a lost connection, and max retries of an idempotent Call after ErrConnLost
+	Retries int
+	// wait before the second redial attempt, doubled after each failed attempt up to Max_Backoff
+	Backoff time.Duration
+	// report whether a Call of the method may be sent again after ErrConnLost, nil means no method
+	Idempotent func(method string) bool
+	// max wait of a Call and CallContext including retries, ErrTimeout is returned after it, 0 means no timeout.
+	// the earlier of the timeout and the CallContext deadline wins
+	CallTimeout time.Duration
+
+	// protocol version of the requests, agreed by the handshake
+	version byte
+
+	// lock writing request
+	sending sync.Mutex
+	// start reading responses at the first request, after the client is configured
+	inputOnce sync.Once
+
+	// handlers of the requests pushed by the server
+	handlerLock sync.RWMutex
+	handlers map[string]server.Handler
+
+	// protect following
+	mutex sync.Mutex
+	seq protocol.SeqGenerator
+	pending map[uint64]*Call
+	closing bool
+	shutdown bool
+}
+
+// NewClient returns a new Client to handle requests on the conn
+func NewClient(conn net.Conn) *Client {
+	client := &Client{
+		conn: protocol.NewConn(conn),
+		SerializeType: protocol.Serialize_Json,
+		CompressThreshold: protocol.Default_Compress_Threshold,
+		GzipLevel: gzip.DefaultCompression,
+		pending: make(map[uint64]*Call),
+	}
+	return client
+}
+
+// NewClientVersion agree on a protocol version in [minVersion, maxVersion] with the server,
+// then returns a new Client to handle requests on the conn with the agreed version.
+// the handshake must be the first message on the conn, a server without the handshake
+// answers it with a protocol.Err_Code_Method_Not_Found *protocol.RPCError. the conn is not closed if no version is agreed
+func NewClientVersion(conn net.Conn, minVersion, maxVersion byte) (*Client, error) {
+	version, err := handshake(conn, minVersion, maxVersion)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{
+		conn: protocol.NewConn(conn),
+		SerializeType: protocol.Serialize_Json,
+		CompressThreshold: protocol.Default_Compress_Threshold,
+		GzipLevel: gzip.DefaultCompression,
+		version: version,
+		pending: make(map[uint64]*Call),
+	}
+	return client, nil
+}
+
+// send the supported version range and read the version chosen by the server,
+// the handshake is written in version 0 which every server reads
+func handshake(conn net.Conn, minVersion, maxVersion byte) (byte, error) {
+	req := protocol.NewMessage()
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.MetaData[protocol.Meta_Min_Version] = strconv.Itoa(int(minVersion))
+	req.MetaData[protocol.Meta_Max_Version] = strconv.Itoa(int(maxVersion))
+	_, err := req.WriteTo(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := protocol.ReadMessage(conn)
+	if err != nil {
+		return 0, err
+	}
+	if res.Header.MessageStatusType() == protocol.Message_Status_Exception {
+		return 0, responseError(res)
+	}
+	version := res.Header.Version()
+	if version < minVersion || version > maxVersion {
+		return 0, fmt.Errorf("rpc: server chose unsupported protocol version %d", version)
+	}
+	return version, nil
+}
+
+// Dial connects to a kitten rpc server at the specified network address
+func Dial(network, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// Option option of DialWithOptions
+type Option func(*dialOptions)
+
+type dialOptions struct {
+	timeout time.Duration
+	tlsConfig *tls.Config
+	keepAlive net.KeepAliveConfig
+}
+
+// WithTimeout bound the connect time, and the TLS handshake of WithTLSConfig, 0 means no timeout
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *dialOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithKeepAlive enable tcp keepalive of the connection, period is the idle time before the first probe
+// and between probes, count the unanswered probes before a dead server is dropped and the calls fail.
+// 0 means the system default
+func WithKeepAlive(period time.Duration, count int) Option {
+	return func(o *dialOptions) {
+		o.keepAlive = net.KeepAliveConfig{Enable: true, Idle: period, Interval: period, Count: count}
+	}
+}
+
+// WithTLSConfig connect over TLS with the config, the server must accept TLS connections
+// without the http layer, e.g. Serve of a tls.NewListener
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *dialOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// dialer of the connect timeout and the tcp keepalive of the options
+func (o *dialOptions) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: o.timeout, KeepAliveConfig: o.keepAlive}
+}
+
+// DialWithOptions connects to a kitten rpc server at the specified network address like Dial with the options
+func DialWithOptions(network, address string, opts ...Option) (*Client, error) {
+	options := &dialOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	dialer := options.dialer()
+	var conn net.Conn
+	var err error
+	if options.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, network, address, options.tlsConfig)
+	}else {
+		conn, err = dialer.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// DialHTTP connects to a kitten rpc server at the specified network address
+// listening on the default rpc http path
+func DialHTTP(network, address string) (*Client, error) {
+	return DialHTTPPath(network, address, server.Http_Path_Rpc)
+}
+
+// DialHTTPPath connects to a kitten rpc server at the specified network address and path
+func DialHTTPPath(network, address, path string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+
+	// require successful http response before switching to rpc protocol
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.StatusCode == http.StatusOK {
+		return NewClient(conn), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected http response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, &net.OpError{
+		Op:   "dial-http",
+		Net:  network + " " + address,
+		Addr: nil,
+		Err:  err,
+	}
+}
+
+// Go invokes the function asynchronously, it returns the Call structure representing the invocation.
+// The done channel will signal when the call is complete by returning the same Call object.
+// If done is nil, Go will allocate a new channel, if non-nil, done must be buffered or Go will deliberately crash
+func (client *Client) Go(method string, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := &Call{
+		Method: method,
+		Args: args,
+		Reply: reply,
+	}
+	if done == nil {
+		done = make(chan *Call, 10)
+	}else if cap(done) == 0 {
+		panic("rpc: done channel is unbuffered")
+	}
+	call.Done = done
+	client.send(call)
+	return call
+}
+
+// Call invokes the named function, waits for it to complete, and returns its error status
+func (client *Client) Call(method string, args interface{}, reply interface{}) error {
+	if client.CallTimeout > 0 {
+		return client.CallContext(context.Background(), method, args, reply)
+	}
+	call := <-client.Go(method, args, reply, make(chan *Call, 1)).Done
+	for i := 0; i < client.Retries && client.retry(call); i++ {
+		call = <-client.Go(method, args, reply, make(chan *Call, 1)).Done
+	}
+	return call.Error
+}
+
+// the call failed by a lost connection and may be sent again
+func (client *Client) retry(call *Call) bool {
+	return call.Error == ErrConnLost && client.Idempotent != nil && client.Idempotent(call.Method)
+}
+
+// CallContext invokes the named function like Call, the deadline of ctx is sent to the server
+// in the request meta, it returns ctx.Err() if ctx is done before the response
+func (client *Client) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	parent := ctx
+	if client.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.CallTimeout)
+		defer cancel()
+	}
+	call := &Call{
+		Method: method,
+		Args: args,
+		Reply: reply,
+		Done: make(chan *Call, 1),
+		ctx: ctx,
+	}
+	client.send(call)
+	for i := 0; ; i++ {
+		select {
+		case call = <-call.Done:
+			if i < client.Retries && client.retry(call) && ctx.Err() == nil {
+				call.Error = nil
+				client.send(call)
+				continue
+			}
+			if expired(ctx) {
+				// the response raced the deadline, e.g. the deadline exception of the server
+				return timeoutError(parent)
+			}
+			return call.Error
+		case <-ctx.Done():
+			// the late response has no pending call
+			client.mutex.Lock()
+			delete(client.pending, call.seq)
+			client.mutex.Unlock()
+			return timeoutError(parent)
+		}
+	}
+}
+
+// report whether ctx is done or its deadline passed, the timer of ctx may not have fired yet
+func expired(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// error of a call whose context expired, ErrTimeout if the client timeout is earlier than parent
+func timeoutError(parent context.Context) error {
+	if !expired(parent) {
+		return ErrTimeout
+	}
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	return context.DeadlineExceeded
+}
+
+// Ping call the reserved protocol.Method_Ping answered by every server, return the round trip latency
+func (client *Client) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	err := client.CallContext(ctx, protocol.Method_Ping, nil, nil)
+	return time.Since(start), err
+}
+
+// Handle registers the handler of the requests of the method pushed by the server,
+// the handler is called in its own goroutine and the response is written back with the same seq.
+// requests are read once the client sends its first request
+func (client *Client) Handle(method string, handler server.Handler) {
+	client.handlerLock.Lock()
+	defer client.handlerLock.Unlock()
+	if client.handlers == nil {
+		client.handlers = make(map[string]server.Handler)
+	}
+	client.handlers[method] = handler
+}
+
+// CallOneWay invokes the named function without waiting for a response,
+// it returns once the request is written, the server sends no response for one way requests
+func (client *Client) CallOneWay(method string, args interface{}) error {
+	req, err := client.newRequest(method, args)
+	if err != nil {
+		return err
+	}
+	req.Header.SetOneWay(true)
+
+	client.startInput()
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	err = client.reconnect()
+	if err != nil {
+		return err
+	}
+
+	client.mutex.Lock()
+	if client.shutdown || client.closing {
+		client.mutex.Unlock()
+		return ErrShutdown
+	}
+	req.Header.SetSeq(client.seq.Next())
+	client.mutex.Unlock()
+
+	_, err = client.conn.WriteMessage(req)
+	return err
+}
+
+// new request message of the method, args is encoded by the client serialize type
+func (client *Client) newRequest(method string, args interface{}) (*protocol.Message, error) {
+	codec, err := protocol.GetCodec(client.SerializeType)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := codec.Encode(args)
+	if err != nil {
+		return nil, err
+	}
+
+	req := protocol.NewMessage()
+	req.Header.SetVersion(client.version)
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.Header.SetSerializeType(client.SerializeType)
+	req.Header.SetCompressType(client.CompressType)
+	req.SetCompressThreshold(client.CompressThreshold)
+	req.SetGzipLevel(client.GzipLevel)
+	req.SetAuthKey(client.AuthKey)
+	req.SetByteOrder(client.ByteOrder)
+	if client.MagicNumber != 0 {
+		req.Header.SetMagicNumber(client.MagicNumber)
+	}
+	req.SetMethod(method)
+	if client.AcceptCompress != nil {
+		req.SetAcceptCompress(client.AcceptCompress...)
+	}
+	req.SetPayload(payload)
+	return req, nil
+}
+
+// send the request of the call
+func (client *Client) send(call *Call) {
+	req, err := client.newRequest(call.Method, call.Args)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+	if call.ctx != nil {
+		if deadline, ok := call.ctx.Deadline(); ok {
+			req.MetaData[protocol.Meta_Deadline] = strconv.FormatInt(deadline.UnixNano(), 10)
+		}
+		if trace, ok := protocol.TraceFromContext(call.ctx); ok {
+			req.SetTrace(trace)
+		}
+	}
+
+	client.startInput()
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	err = client.reconnect()
+	if err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+
+	// register this call
+	client.mutex.Lock()
+	if client.shutdown || client.closing {
+		client.mutex.Unlock()
+		call.Error = ErrShutdown
+		call.done()
+		return
+	}
+	seq := client.seq.Next()
+	call.seq = seq
+	client.pending[seq] = call
+	client.mutex.Unlock()
+
+	req.Header.SetSeq(seq)
+	// flushed at once, a request left in the buffer would never be answered
+	_, err = client.conn.WriteMessage(req)
+	if err != nil && client.Redial != nil {
+		// the write may be partial, the connection is lost
+		client.conn.Close()
+		client.terminate(client.conn, err)
+	}else if err != nil {
+		client.mutex.Lock()
+		call = client.pending[seq]
+		delete(client.pending, seq)
+		client.mutex.Unlock()
+		if call != nil {
+			call.Error = err
+			call.done()
+		}
+	}
+}
+
+// start reading responses
+func (client *Client) startInput() {
+	client.inputOnce.Do(func() {
+		client.mutex.Lock()
+		conn := client.conn
+		client.mutex.Unlock()
+		go client.input(conn)
+	})
+}
+
+// redial the lost connection with backoff if Redial is set, the sending lock is held
+func (client *Client) reconnect() error {
+	client.mutex.Lock()
+	lost := client.shutdown && !client.closing && client.Redial != nil
+	client.mutex.Unlock()
+	if !lost {
+		return nil
+	}
+
+	var err error
+	backoff := client.Backoff
+	for i := 0; i <= client.Retries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > Max_Backoff {
+				backoff = Max_Backoff
+			}
+		}
+		var conn net.Conn
+		conn, err = client.Redial()
+		if err != nil {
+			continue
+		}
+
+		client.mutex.Lock()
+		if client.closing {
+			client.mutex.Unlock()
+			conn.Close()
+			return ErrShutdown
+		}
+		bc := protocol.NewConn(conn)
+		client.conn = bc
+		client.shutdown = false
+		client.mutex.Unlock()
+		go client.input(bc)
+		return nil
+	}
+	return err
+}
+
+// read responses of the conn and deliver them to the pending calls by seq
+func (client *Client) input(conn *protocol.Conn) {
+	var err error
+	var res *protocol.Message
+	opts := protocol.ReadOptions{AuthKey: client.AuthKey, ByteOrder: client.ByteOrder, MagicNumber: client.MagicNumber}
+	for err == nil {
+		res, err = protocol.ReadMessageOptions(conn, opts)
+		if err != nil {
+			break
+		}
+		if res.Header.MessageType() == protocol.Message_Type_Request {
+			go client.serveRequest(conn, res)
+			continue
+		}
+		seq := res.Header.Seq()
+		client.mutex.Lock()
+		call := client.pending[seq]
+		if call != nil && !call.matches(res) {
+			// late response of a completed call of the recycled seq
+			call = nil
+		}else {
+			delete(client.pending, seq)
+		}
+		client.mutex.Unlock()
+
+		if call == nil {
+			// no pending call, the write partially failed and the call was already removed
+			continue
+		}
+		call.Meta = res.MetaData
+		if res.Header.MessageStatusType() == protocol.Message_Status_Exception {
+			call.Error = responseError(res)
+		}else if call.Reply != nil {
+			call.Error = decodeReply(res, call.Reply)
+		}
+		call.done()
+	}
+
+	client.sending.Lock()
+	client.terminate(conn, err)
+	client.sending.Unlock()
+}
+
+// terminate the pending calls of the dead conn, the sending lock is held
+func (client *Client) terminate(conn *protocol.Conn, err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.conn != conn {
+		// the pending calls of the conn were terminated before the reconnection
+		return
+	}
+	client.shutdown = true
+	if client.closing {
+		err = ErrShutdown
+	}else if client.Redial != nil {
+		err = ErrConnLost
+	}else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	for _, call := range client.pending {
+		call.Error = err
+		call.done()
+	}
+	client.pending = make(map[uint64]*Call)
+}
+
+// serve the request pushed by the server on the conn by the registered handler
+func (client *Client) serveRequest(conn *protocol.Conn, req *protocol.Message) {
+	method := req.Method()
+	client.handlerLock.RLock()
+	handler, ok := client.handlers[method]
+	client.handlerLock.RUnlock()
+
+	res := protocol.NewMessage()
+	res.Header.SetVersion(req.Header.Version())
+	res.Header.SetMessageType(protocol.Message_Type_Response)
+	res.Header.SetSerializeType(req.Header.SerializeType())
+	res.Header.SetSeq(req.Header.Seq())
+	res.SetMethod(method)
+	res.SetAuthKey(client.AuthKey)
+	res.SetByteOrder(client.ByteOrder)
+	if client.MagicNumber != 0 {
+		res.Header.SetMagicNumber(client.MagicNumber)
+	}
+
+	var err error
+	if ok {
+		err = callHandler(method, handler, req, res)
+	}else {
+		err = protocol.NewRPCError(protocol.Err_Code_Method_Not_Found, "rpc: can't find method " + method)
+	}
+	// one way request has no response, even on error
+	if req.Header.IsOneWay() {
+		return
+	}
+	if err != nil {
+		res.Header.SetMessageStatusType(protocol.Message_Status_Exception)
+		res.SetPayload([]byte(err.Error()))
+		if rpcErr, ok := err.(*protocol.RPCError); ok {
+			res.SetRPCError(rpcErr)
+		}
+	}
+
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	conn.WriteMessage(res)
+}
+
+// call the handler and recover the panic to an error
+func callHandler(method string, handler server.Handler, req *protocol.Message, res *protocol.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rpc: method %s panic: %v", method, r)
+		}
+	}()
+	return handler(context.Background(), req, res)
+}
+
+// error of the exception response, the *protocol.RPCError of the meta or the ServerError of the payload
+func responseError(res *protocol.Message) error {
+	if rpcErr := res.RPCError(); rpcErr != nil {
+		return rpcErr
+	}
+	return ServerError(res.Payload)
+}
+
+// decode response payload by the codec of response serialize type
+func decodeReply(res *protocol.Message, reply interface{}) error {
+	codec, err := protocol.GetCodec(res.Header.SerializeType())
+	if err != nil {
+		return err
+	}
+	return codec.Decode(res.Payload, reply)
+}
+
+// is the connection shut down
+func (client *Client) isShutdown() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.shutdown || client.closing
+}
+
+// Close the client connection
+func (client *Client) Close() error {
+	client.mutex.Lock()
+	if client.closing {
+		client.mutex.Unlock()
+		return ErrShutdown
+	}
+	client.closing = true
+	client.mutex.Unlock()
+	return client.conn.Close()
+}
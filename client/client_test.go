@@ -0,0 +1,839 @@
+package client
+
+import (
+	"testing"
+	"net"
+	"errors"
+	"sync"
+	"context"
+	"encoding/json"
+	"time"
+	"strings"
+	"path/filepath"
+	"math/big"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"github.com/phachon/kitten/protocol"
+	"github.com/phachon/kitten/server"
+)
+
+type Args struct {
+	A int
+	B int
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith int
+
+func (t *Arith) Add(args Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func (t *Arith) Div(args Args, reply *Reply) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	reply.C = args.A / args.B
+	return nil
+}
+
+// start an in-process server and return a client connected over net.Pipe
+func newPipeClient(t *testing.T) *Client {
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	serverConn, clientConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	return NewClient(clientConn)
+}
+
+func TestPing(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		latency, err := client.Ping(context.Background())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if latency <= 0 || latency > time.Second {
+			t.Fatal("ping latency error")
+		}
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client, err := NewClientVersion(clientConn, protocol.Min_Version, protocol.Max_Version)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("call reply false")
+	}
+
+	// client requires a newer version than the server supports
+	serverConn, clientConn = net.Pipe()
+	go s.ServeConn(serverConn)
+	defer clientConn.Close()
+	_, err = NewClientVersion(clientConn, protocol.Max_Version+1, protocol.Max_Version+1)
+	if _, ok := err.(ServerError); !ok {
+		t.Fatal("mismatched version must return ServerError")
+	}
+	_, err = protocol.ReadMessage(clientConn)
+	if err == nil {
+		t.Fatal("mismatched version connection must be closed")
+	}
+}
+
+func TestCall(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	reply := new(Reply)
+	err := client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("reply error")
+	}
+
+	err = client.Call("Arith.Div", Args{7, 0}, reply)
+	if _, ok := err.(ServerError); !ok || err.Error() != "divide by zero" {
+		t.Fatal("handler error must be server error")
+	}
+
+	err = client.Call("Arith.Unknown", Args{7, 8}, reply)
+	if rpcErr, ok := err.(*protocol.RPCError); !ok || rpcErr.Code != protocol.Err_Code_Method_Not_Found ||
+		!strings.Contains(rpcErr.Message, "Arith.Unknown") {
+		t.Fatal("unknown method must be method not found error")
+	}
+
+	// the connection is still usable
+	err = client.Call("Arith.Add", Args{1, 2}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 3 {
+		t.Fatal("reply error")
+	}
+}
+
+func (t *Arith) Find(args Args, reply *Reply) error {
+	return protocol.NewRPCError(protocol.Err_Code_Not_Found, "arith not found")
+}
+
+func TestRPCError(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	err := client.Call("Arith.Find", Args{}, new(Reply))
+	rpcErr, ok := err.(*protocol.RPCError)
+	if !ok {
+		t.Fatal("handler RPCError must be RPCError")
+	}
+	if rpcErr.Code != protocol.Err_Code_Not_Found || rpcErr.Message != "arith not found" {
+		t.Fatal("RPCError code and message error")
+	}
+
+	err = client.Call("Arith.Div", Args{1, 0}, new(Reply))
+	if _, ok := err.(ServerError); !ok {
+		t.Fatal("handler error without code must be ServerError")
+	}
+}
+
+func (t *Arith) Deadline(ctx context.Context, args Args, reply *int64) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline")
+	}
+	*reply = deadline.UnixNano()
+	return nil
+}
+
+func TestCallContext(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	var reply int64
+	err := client.CallContext(ctx, "Arith.Deadline", Args{}, &reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply != deadline.UnixNano() {
+		t.Fatal("handler deadline must be the call context deadline")
+	}
+
+	err = client.Call("Arith.Deadline", Args{}, &reply)
+	if _, ok := err.(ServerError); !ok {
+		t.Fatal("call without context must have no deadline")
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err = client.CallContext(ctx, "Arith.Deadline", Args{}, &reply)
+	if err != context.DeadlineExceeded {
+		t.Fatal("expired context must return context.DeadlineExceeded")
+	}
+}
+
+func TestCallContextCancel(t *testing.T) {
+
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	s.Handle("Arith.Wait", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		started <- true
+		<-release
+		return nil
+	})
+	serverConn, clientConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	err = client.CallContext(ctx, "Arith.Wait", Args{}, nil)
+	if err != context.Canceled {
+		t.Fatal("cancelled call must return context.Canceled")
+	}
+	client.mutex.Lock()
+	pending := len(client.pending)
+	client.mutex.Unlock()
+	if pending != 0 {
+		t.Fatal("cancelled call must be removed from pending")
+	}
+
+	// the late response is dropped
+	close(release)
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("reply error")
+	}
+}
+
+// serve the server on the address, return the listener and the accepted conns
+func listenServer(t *testing.T, s *server.Server, address string) (net.Listener, chan net.Conn) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go s.ServeConn(conn)
+		}
+	}()
+	return l, conns
+}
+
+func TestCallTimeout(t *testing.T) {
+
+	s := server.NewServer()
+	release := make(chan bool)
+	defer close(release)
+	s.Handle("Arith.Never", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		<-release
+		return nil
+	})
+	serverConn, clientConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client := NewClient(clientConn)
+	client.CallTimeout = 100 * time.Millisecond
+	defer client.Close()
+
+	start := time.Now()
+	err := client.Call("Arith.Never", Args{}, nil)
+	if err != ErrTimeout {
+		t.Fatal("call not answered must return ErrTimeout")
+	}
+	if time.Since(start) < client.CallTimeout {
+		t.Fatal("call must wait for the timeout")
+	}
+	client.mutex.Lock()
+	pending := len(client.pending)
+	client.mutex.Unlock()
+	if pending != 0 {
+		t.Fatal("timed out call must be removed from pending")
+	}
+
+	// the earlier context deadline wins
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	err = client.CallContext(ctx, "Arith.Never", Args{}, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatal("earlier context deadline must return context.DeadlineExceeded")
+	}
+	err = client.CallContext(context.Background(), "Arith.Never", Args{}, nil)
+	if err != ErrTimeout {
+		t.Fatal("earlier client timeout must return ErrTimeout")
+	}
+}
+
+// response of the request with the method and the json payload
+func writeResponse(conn net.Conn, req *protocol.Message, method string, payload string) {
+	res := protocol.NewMessage()
+	res.Header.SetMessageType(protocol.Message_Type_Response)
+	res.Header.SetSerializeType(req.Header.SerializeType())
+	res.Header.SetSeq(req.Header.Seq())
+	res.SetMethod(method)
+	res.SetPayload([]byte(payload))
+	res.WriteTo(conn)
+}
+
+func (t *Arith) Quota(ctx context.Context, args Args, reply *Reply) error {
+	if !server.SetResponseMeta(ctx, "quota-remaining", "41") {
+		return errors.New("no response in the context")
+	}
+	reply.C = args.A
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+
+	s := server.NewServer()
+	traces := make(chan protocol.Trace, 1)
+	s.Handle("Trace.Span", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		trace, _ := protocol.TraceFromContext(ctx)
+		traces <- trace
+		return nil
+	})
+	serverConn, clientConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	ctx := protocol.WithTrace(context.Background(), "trace-1", "span-1")
+	ctx = protocol.WithTrace(ctx, "trace-1", "span-2")
+	err := client.CallContext(ctx, "Trace.Span", nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	trace := <-traces
+	if trace.TraceID != "trace-1" || trace.SpanID != "span-2" || trace.ParentSpanID != "span-1" {
+		t.Fatal("trace must round trip to the handler context")
+	}
+}
+
+func TestResponseMeta(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	reply := &Reply{}
+	call := <-client.Go("Arith.Quota", Args{7, 0}, reply, nil).Done
+	if call.Error != nil {
+		t.Fatal(call.Error.Error())
+	}
+	if reply.C != 7 || call.Meta["quota-remaining"] != "41" {
+		t.Fatal("response meta set by the method must be read back")
+	}
+}
+
+func TestLateResponse(t *testing.T) {
+
+	serverConn, clientConn := net.Pipe()
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	go func() {
+		req, err := protocol.ReadMessage(serverConn)
+		if err != nil {
+			return
+		}
+		writeResponse(serverConn, req, req.Method(), `{"C":2}`)
+		req, err = protocol.ReadMessage(serverConn)
+		if err != nil {
+			return
+		}
+		// a late response of another call of the same seq comes first
+		writeResponse(serverConn, req, "Arith.Mul", `{"C":6}`)
+		writeResponse(serverConn, req, req.Method(), `{"C":5}`)
+	}()
+
+	reply := &Reply{}
+	err := client.Call("Arith.Mul", Args{1, 2}, reply)
+	if err != nil || reply.C != 2 {
+		t.Fatal("first call must be answered")
+	}
+	// the seq of the completed call is reused
+	client.mutex.Lock()
+	client.seq = protocol.SeqGenerator{}
+	client.mutex.Unlock()
+	reply = &Reply{}
+	err = client.Call("Arith.Add", Args{2, 3}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 5 {
+		t.Fatal("late response of another method must be discarded")
+	}
+}
+
+func TestRedial(t *testing.T) {
+
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	defer close(release)
+	s.Handle("Arith.Wait", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		started <- true
+		<-release
+		return nil
+	})
+
+	l, conns := listenServer(t, s, "127.0.0.1:0")
+	address := l.Addr().String()
+	client, err := Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	client.Redial = func() (net.Conn, error) {
+		return net.Dial("tcp", address)
+	}
+	client.Retries = 5
+	client.Backoff = 10 * time.Millisecond
+	client.Idempotent = func(method string) bool {
+		return method == "Arith.Add"
+	}
+
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// kill the server with a call in flight
+	call := client.Go("Arith.Wait", Args{}, nil, nil)
+	<-started
+	l.Close()
+	(<-conns).Close()
+	<-call.Done
+	if call.Error != ErrConnLost {
+		t.Fatal("in flight call of a lost connection must return ErrConnLost")
+	}
+
+	// restart the server
+	l, _ = listenServer(t, s, address)
+	defer l.Close()
+	reply = new(Reply)
+	err = client.Call("Arith.Add", Args{1, 2}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 3 {
+		t.Fatal("reply error")
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	address := filepath.Join(t.TempDir(), "kitten.sock")
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	go s.Serve(l)
+
+	client, err := Dial("unix", address)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("reply error")
+	}
+}
+
+func TestDialKeepAlive(t *testing.T) {
+
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	l, _ := listenServer(t, s, "127.0.0.1:0")
+	defer l.Close()
+
+	// the keepalive reaches the dialer, which sets it on the *net.TCPConn
+	options := &dialOptions{}
+	WithKeepAlive(time.Second, 3)(options)
+	config := options.dialer().KeepAliveConfig
+	if !config.Enable || config.Idle != time.Second || config.Interval != time.Second || config.Count != 3 {
+		t.Fatal("keepalive config of the dialer error")
+	}
+
+	client, err := DialWithOptions("tcp", l.Addr().String(), WithKeepAlive(time.Second, 3))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("reply error")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+
+	// unroutable TEST-NET-1 address
+	start := time.Now()
+	_, err := DialWithOptions("tcp", "192.0.2.1:80", WithTimeout(100 * time.Millisecond))
+	if err == nil {
+		t.Fatal("dial unreachable address must fail")
+	}
+	if time.Since(start) > 5 * time.Second {
+		t.Fatal("dial must stop at the timeout")
+	}
+}
+
+// self signed certificate of 127.0.0.1
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{Organization: []string{"kitten"}},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA: true,
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestDialTLS(t *testing.T) {
+
+	cert, pool := selfSignedCert(t)
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	go s.Serve(tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	client, err := DialWithOptions("tcp", l.Addr().String(), WithTimeout(time.Second), WithTLSConfig(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	if _, ok := client.conn.Conn.(*tls.Conn); !ok {
+		t.Fatal("client conn must be tls")
+	}
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("reply error")
+	}
+}
+
+func TestAuthKey(t *testing.T) {
+
+	s := server.NewServer()
+	s.AuthKey = []byte("kitten secret")
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client := NewClient(clientConn)
+	client.AuthKey = []byte("kitten secret")
+	defer client.Close()
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("reply error")
+	}
+
+	// request without hmac, the server closes the connection
+	serverConn, clientConn = net.Pipe()
+	go s.ServeConn(serverConn)
+	client = NewClient(clientConn)
+	defer client.Close()
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err == nil {
+		t.Fatal("call without hmac must fail")
+	}
+}
+
+func TestCallCompress(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	// compress the small request payload too
+	client.CompressType = protocol.Compress_Type_Gzip
+	client.CompressThreshold = 0
+	reply := new(Reply)
+	err := client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("reply error")
+	}
+}
+
+func TestConcurrentCall(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply := new(Reply)
+			err := client.Call("Arith.Add", Args{i, i}, reply)
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			if reply.C != i+i {
+				t.Error("reply error")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCallAfterClose(t *testing.T) {
+
+	client := newPipeClient(t)
+	client.Close()
+
+	err := client.Call("Arith.Add", Args{7, 8}, new(Reply))
+	if err != ErrShutdown {
+		t.Fatal("call after close must return ErrShutdown")
+	}
+}
+
+func TestGo(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	calls := make([]*Call, 10)
+	for i := range calls {
+		calls[i] = client.Go("Arith.Add", Args{i, 1}, new(Reply), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			t.Fatal(call.Error.Error())
+		}
+		if call.Reply.(*Reply).C != i+1 {
+			t.Fatal("reply error")
+		}
+	}
+
+	// shared done channel
+	done := make(chan *Call, 3)
+	client.Go("Arith.Add", Args{1, 2}, new(Reply), done)
+	client.Go("Arith.Div", Args{1, 0}, new(Reply), done)
+	client.Go("Arith.Div", Args{4, 2}, new(Reply), done)
+	errCount := 0
+	for i := 0; i < 3; i++ {
+		call := <-done
+		if call.Error != nil {
+			if _, ok := call.Error.(ServerError); !ok {
+				t.Fatal("handler error must be server error")
+			}
+			errCount++
+		}
+	}
+	if errCount != 1 {
+		t.Fatal("exception response error count wrong")
+	}
+}
+
+func TestCallOneWay(t *testing.T) {
+
+	s := server.NewServer()
+	called := make(chan int, 1)
+	s.Handle("Arith.Notify", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		args := Args{}
+		err := json.Unmarshal(req.Payload, &args)
+		called <- args.A
+		return err
+	})
+	serverConn, clientConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	err := client.CallOneWay("Arith.Notify", Args{3, 4})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if <-called != 3 {
+		t.Fatal("one way handler is not called")
+	}
+}
+
+func TestClientHandle(t *testing.T) {
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	client := NewClient(clientConn)
+	defer client.Close()
+	client.Handle("Notify.Push", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(append([]byte("pushed "), req.Payload...))
+		return nil
+	})
+
+	// the client reads once it sends a request
+	go client.CallOneWay("Arith.Notify", Args{1, 2})
+	_, err := protocol.ReadMessage(serverConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, method := range []string{"Notify.Push", "Notify.Unknown"} {
+		req := protocol.NewMessage()
+		req.Header.SetMessageType(protocol.Message_Type_Request)
+		req.Header.SetSeq(100)
+		req.MetaData[protocol.Meta_Method] = method
+		req.SetPayload([]byte("kitten"))
+		_, err = req.WriteTo(serverConn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res, err := protocol.ReadMessage(serverConn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.Header.MessageType() != protocol.Message_Type_Response || res.Header.Seq() != 100 {
+			t.Fatal("pushed request response error")
+		}
+		if method == "Notify.Push" && string(res.Payload) != "pushed kitten" {
+			t.Fatal("client handler is not called")
+		}
+		if method == "Notify.Unknown" && res.Header.MessageStatusType() != protocol.Message_Status_Exception {
+			t.Fatal("unknown method must be exception")
+		}
+	}
+
+}
+
+func (t *Arith) Panic(args Args, reply *Reply) error {
+	panic("arith panic")
+}
+
+func TestCallPanic(t *testing.T) {
+
+	client := newPipeClient(t)
+	defer client.Close()
+
+	err := client.Call("Arith.Panic", Args{1, 2}, new(Reply))
+	if _, ok := err.(ServerError); !ok {
+		t.Fatal("handler panic must be server error")
+	}
+
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{1, 2}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 3 {
+		t.Fatal("reply error")
+	}
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"io"
+	"net"
+	"time"
+	"errors"
+	"net/http"
+)
+
+// the http stream has no deadline
+var errStreamDeadline = errors.New("rpc: deadline not supported by the http stream")
+
+// DialHTTP2 connects to a kitten rpc server over the bidirectional POST stream of server.ServeHTTP2
+// at url, e.g. "https://host" + server.Http_Path_Stream of ServeTLS, for proxies forbidding CONNECT.
+// the stream must be HTTP/2, httpClient must speak it to the server, nil means http.DefaultClient
+func DialHTTP2(httpClient *http.Client, url string) (*Client, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	body, w := io.Pipe()
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	// the server answers the headers before reading the requests
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		w.Close()
+		return nil, &net.OpError{
+			Op:   "dial-http2",
+			Net:  "http",
+			Addr: nil,
+			Err:  errors.New("unexpected http response: " + resp.Status),
+		}
+	}
+	return NewClient(&streamConn{
+		w: w,
+		body: resp.Body,
+		remoteAddr: streamAddr(url),
+	}), nil
+}
+
+// net.Conn of the request and response bodies of an http stream
+type streamConn struct {
+	w *io.PipeWriter
+	body io.ReadCloser
+	remoteAddr net.Addr
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// end the request body and the response body
+func (c *streamConn) Close() error {
+	c.w.Close()
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return streamAddr("")
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return errStreamDeadline
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return errStreamDeadline
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return errStreamDeadline
+}
+
+// address of an http stream, the url of the stream
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "http"
+}
+
+func (a streamAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/phachon/kitten/server"
+)
+
+func TestDialHTTP2(t *testing.T) {
+
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.Handle(server.Http_Path_Stream, http.HandlerFunc(s.ServeHTTP2))
+	ts := httptest.NewUnstartedServer(mux)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	client, err := DialHTTP2(ts.Client(), ts.URL + server.Http_Path_Stream)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		reply := new(Reply)
+		err = client.Call("Arith.Add", Args{i, 1}, reply)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if reply.C != i+1 {
+			t.Fatal("reply over the http stream error")
+		}
+	}
+
+	// a path without the stream handler
+	_, err = DialHTTP2(ts.Client(), ts.URL + "/missing")
+	if err == nil {
+		t.Fatal("stream answered without 200 must return error")
+	}
+}
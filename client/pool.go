@@ -0,0 +1,135 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Pool of up to size clients to the same address, a call borrows the client with the
+// least calls in flight and a new client is dialed while all the clients are busy.
+// a broken client is evicted when it is returned and replaced by a later dial
+type Pool struct {
+	dial func() (*Client, error)
+	size int
+
+	// protect following
+	mutex sync.Mutex
+	clients []*poolClient
+	dialing int
+	closed bool
+}
+
+// client of the pool and its calls in flight
+type poolClient struct {
+	client *Client
+	inFlight int
+	// removed from the pool, not borrowed any more
+	evicted bool
+}
+
+// NewPool returns a new Pool of up to size clients created by dial
+func NewPool(size int, dial func() (*Client, error)) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{
+		dial: dial,
+		size: size,
+	}
+}
+
+// Call invokes the named function on a borrowed client like Client.Call
+func (pool *Pool) Call(method string, args interface{}, reply interface{}) error {
+	pc, err := pool.get()
+	if err != nil {
+		return err
+	}
+	err = pc.client.Call(method, args, reply)
+	pool.put(pc, err)
+	return err
+}
+
+// borrow the client with the least calls in flight, dial a new one if it is busy and the pool is not full
+func (pool *Pool) get() (*poolClient, error) {
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		return nil, ErrShutdown
+	}
+	var best *poolClient
+	for _, pc := range pool.clients {
+		if best == nil || pc.inFlight < best.inFlight {
+			best = pc
+		}
+	}
+	if best != nil && (best.inFlight == 0 || len(pool.clients) + pool.dialing >= pool.size) {
+		best.inFlight++
+		pool.mutex.Unlock()
+		return best, nil
+	}
+	pool.dialing++
+	pool.mutex.Unlock()
+
+	client, err := pool.dial()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.dialing--
+	if err != nil {
+		return nil, err
+	}
+	if pool.closed {
+		client.Close()
+		return nil, ErrShutdown
+	}
+	pc := &poolClient{client: client, inFlight: 1}
+	pool.clients = append(pool.clients, pc)
+	return pc, nil
+}
+
+// return the borrowed client, evict it if its connection is shut down or the call failed by a
+// broken connection. any response of the server, a ServerError or a *protocol.RPCError, keeps it.
+// the evicted client is closed after its last call in flight
+func (pool *Pool) put(pc *poolClient, err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pc.inFlight--
+	if !pc.evicted && (pc.client.isShutdown() || broken(err)) {
+		pc.evicted = true
+		for i, c := range pool.clients {
+			if c == pc {
+				pool.clients = append(pool.clients[:i], pool.clients[i+1:]...)
+				break
+			}
+		}
+	}
+	if pc.evicted && pc.inFlight == 0 {
+		pc.client.Close()
+	}
+}
+
+// report whether err of a call is a failure of the connection rather than an answer of the server
+func broken(err error) bool {
+	switch err {
+	case ErrConnLost, ErrShutdown, io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Close the pool and all its clients
+func (pool *Pool) Close() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.closed {
+		return ErrShutdown
+	}
+	pool.closed = true
+	for _, pc := range pool.clients {
+		pc.client.Close()
+	}
+	pool.clients = nil
+	return nil
+}
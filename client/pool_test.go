@@ -0,0 +1,173 @@
+package client
+
+import (
+	"testing"
+	"net"
+	"sync"
+	"context"
+	"github.com/phachon/kitten/protocol"
+	"github.com/phachon/kitten/server"
+)
+
+func TestPool(t *testing.T) {
+
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// requests wait until 4 requests are in flight
+	var barrier sync.WaitGroup
+	barrier.Add(4)
+	s.Handle("Arith.Wait", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		barrier.Done()
+		barrier.Wait()
+		return nil
+	})
+
+	var lock sync.Mutex
+	var conns []net.Conn
+	pool := NewPool(4, func() (*Client, error) {
+		serverConn, clientConn := net.Pipe()
+		go s.ServeConn(serverConn)
+		lock.Lock()
+		conns = append(conns, clientConn)
+		lock.Unlock()
+		return NewClient(clientConn), nil
+	})
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := pool.Call("Arith.Wait", Args{}, nil)
+			if err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	if len(conns) != 4 || len(pool.clients) != 4 {
+		t.Fatal("concurrent calls must spread over 4 connections")
+	}
+
+	// the broken client is evicted and replaced
+	conns[0].Close()
+	failed := 0
+	for i := 0; i < 8; i++ {
+		reply := new(Reply)
+		err := pool.Call("Arith.Add", Args{i, 1}, reply)
+		if err != nil {
+			failed++
+			continue
+		}
+		if reply.C != i+1 {
+			t.Fatal("reply error")
+		}
+	}
+	if failed > 1 {
+		t.Fatal("broken client must be evicted")
+	}
+	if len(pool.clients) != 3 {
+		t.Fatal("broken client must be evicted")
+	}
+
+	// the evicted client is replaced when all the clients are busy
+	barrier.Add(4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := pool.Call("Arith.Wait", Args{}, nil)
+			if err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	if len(conns) != 5 || len(pool.clients) != 4 {
+		t.Fatal("evicted client must be replaced")
+	}
+}
+
+func TestPoolServerError(t *testing.T) {
+
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dials := 0
+	pool := NewPool(1, func() (*Client, error) {
+		serverConn, clientConn := net.Pipe()
+		go s.ServeConn(serverConn)
+		dials++
+		return NewClient(clientConn), nil
+	})
+	defer pool.Close()
+
+	// the answers of the server keep the client
+	err = pool.Call("Arith.Find", Args{}, new(Reply))
+	if _, ok := err.(*protocol.RPCError); !ok {
+		t.Fatal("handler RPCError must be RPCError")
+	}
+	err = pool.Call("Arith.Div", Args{1, 0}, new(Reply))
+	if _, ok := err.(ServerError); !ok {
+		t.Fatal("handler error must be ServerError")
+	}
+	err = pool.Call("Arith.Add", Args{1, 1}, new(Reply))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if dials != 1 || len(pool.clients) != 1 {
+		t.Fatal("client answered with an error must not be evicted")
+	}
+}
+
+func TestPoolEvictInFlight(t *testing.T) {
+
+	s := server.NewServer()
+	started := make(chan bool)
+	release := make(chan bool)
+	s.Handle("Arith.Wait", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		started <- true
+		<-release
+		return nil
+	})
+	pool := NewPool(1, func() (*Client, error) {
+		serverConn, clientConn := net.Pipe()
+		go s.ServeConn(serverConn)
+		return NewClient(clientConn), nil
+	})
+	defer pool.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pool.Call("Arith.Wait", Args{}, nil)
+	}()
+	<-started
+
+	// a broken call evicts the client shared with the call in flight
+	pc, err := pool.get()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pool.put(pc, ErrConnLost)
+	if len(pool.clients) != 0 {
+		t.Fatal("broken client must be evicted")
+	}
+	if pc.client.isShutdown() {
+		t.Fatal("evicted client must not be closed before its calls in flight")
+	}
+
+	close(release)
+	err = <-done
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !pc.client.isShutdown() {
+		t.Fatal("evicted client must be closed after its last call")
+	}
+}
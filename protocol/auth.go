@@ -0,0 +1,27 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+const (
+	// hmac length
+	Auth_Len int = sha256.Size
+)
+
+// SetAuthKey set the hmac key of the written message, nil means no hmac.
+// the hmac covers the written header, meta data and payload data
+func (message *Message) SetAuthKey(key []byte) {
+	message.authKey = key
+}
+
+// hmac-sha256 of the header, meta data, payload data and trailer as written
+func authCode(key []byte, header *Header, blocks ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header[:])
+	for _, block := range blocks {
+		mac.Write(block)
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"testing"
+	"bytes"
+)
+
+func TestAuth(t *testing.T) {
+
+	key := []byte("kitten secret")
+	opts := ReadOptions{AuthKey: key}
+
+	req := NewMessage()
+	req.Header.SetSeq(9)
+	req.Header.SetChecksum(true)
+	req.MetaData["__METHOD"] = "Author.Login"
+	req.SetPayload([]byte("kitten"))
+	req.SetAuthKey(key)
+
+	// valid
+	var buf bytes.Buffer
+	_, err := req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := append([]byte{}, buf.Bytes()...)
+	encoded, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(encoded, data) {
+		t.Fatal("encode data must equal write to data")
+	}
+	res, err := ReadMessageOptions(&buf, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !res.Header.HasAuth() || string(res.Payload) != "kitten" {
+		t.Fatal("authenticated message error")
+	}
+	if req.Header.HasAuth() {
+		t.Fatal("request header must not be changed")
+	}
+	res, err = Decode(data)
+	if err != nil || string(res.Payload) != "kitten" {
+		t.Fatal("decode authenticated message error")
+	}
+
+	// wrong key
+	_, err = ReadMessageOptions(bytes.NewReader(data), ReadOptions{AuthKey: []byte("other")})
+	if err != ErrAuthFailed {
+		t.Fatal("wrong key must return ErrAuthFailed")
+	}
+
+	// tampered seq, the checksum does not cover the header
+	tampered := append([]byte{}, data...)
+	tampered[Header_Len-1] ^= 0x01
+	_, err = ReadMessageOptions(bytes.NewReader(tampered), opts)
+	if err != ErrAuthFailed {
+		t.Fatal("tampered message must return ErrAuthFailed")
+	}
+
+	// missing hmac
+	req.SetAuthKey(nil)
+	data, err = req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = ReadMessageOptions(bytes.NewReader(data), opts)
+	if err != ErrAuthFailed {
+		t.Fatal("missing hmac must return ErrAuthFailed")
+	}
+
+	// stream
+	req.SetAuthKey(key)
+	buf.Reset()
+	err = req.WriteStream(&buf, bytes.NewReader([]byte("kitten")), 6)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err = ReadMessageOptions(&buf, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(res.Payload) != "kitten" {
+		t.Fatal("authenticated stream error")
+	}
+}
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"bytes"
+	"sync"
+	"errors"
+	"encoding/json"
+	"encoding/gob"
+	"google.golang.org/protobuf/proto"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	ErrUnsupportedSerializeType = errors.New("unsupported serialize type")
+	ErrNotProtoMessage = errors.New("value is not a proto.Message")
+)
+
+// Codec serialize and deserialize the payload data
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+var (
+	codecLock sync.RWMutex
+	// serialize type => codec
+	codecs = map[byte]Codec{
+		Serialize_Json: JsonCodec{},
+		Serialize_Protobuf: ProtobufCodec{},
+		Serialize_Msgpack: MsgpackCodec{},
+		Serialize_Gob: GobCodec{},
+	}
+)
+
+// RegisterCodec register the codec of the serialize type, replace the registered one
+func RegisterCodec(serializeType byte, codec Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[serializeType] = codec
+}
+
+// GetCodec get the codec of the serialize type
+func GetCodec(serializeType byte) (Codec, error) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	codec, ok := codecs[serializeType]
+	if !ok {
+		return nil, ErrUnsupportedSerializeType
+	}
+	return codec, nil
+}
+
+// JsonCodec json codec
+type JsonCodec struct{}
+
+// Encode json encode
+func (c JsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Decode json decode
+func (c JsonCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec protobuf codec, value must implement proto.Message
+type ProtobufCodec struct{}
+
+// Encode protobuf encode
+func (c ProtobufCodec) Encode(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(m)
+}
+
+// Decode protobuf decode
+func (c ProtobufCodec) Decode(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// MsgpackCodec msgpack codec
+type MsgpackCodec struct{}
+
+// Encode msgpack encode, integers and floats use the smallest encoding
+func (c MsgpackCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode msgpack decode
+func (c MsgpackCodec) Decode(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// GobCodec gob codec, each payload is encoded by a new encoder and carries its type information
+type GobCodec struct{}
+
+// Encode gob encode
+func (c GobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode gob decode
+func (c GobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
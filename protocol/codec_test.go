@@ -0,0 +1,282 @@
+package protocol
+
+import (
+	"testing"
+	"bytes"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type rawCodec struct{}
+
+func (c rawCodec) Encode(v interface{}) ([]byte, error) {
+	return v.([]byte), nil
+}
+
+func (c rawCodec) Decode(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = data
+	return nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+
+	_, err := GetCodec(0x0f)
+	if err != ErrUnsupportedSerializeType {
+		t.Fatal("unregistered serialize type must return ErrUnsupportedSerializeType")
+	}
+
+	RegisterCodec(0x0f, rawCodec{})
+	t.Cleanup(func() {
+		codecLock.Lock()
+		delete(codecs, 0x0f)
+		codecLock.Unlock()
+	})
+	codec, err := GetCodec(0x0f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := codec.Encode([]byte("kitten"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var v []byte
+	err = codec.Decode(data, &v)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(v, []byte("kitten")) {
+		t.Fatal("raw codec error")
+	}
+}
+
+func TestJsonCodec(t *testing.T) {
+
+	type author struct {
+		Name string
+		Age int
+	}
+
+	codec, err := GetCodec(Serialize_Json)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req := NewMessage()
+	req.Header.SetSerializeType(Serialize_Json)
+	payload, err := codec.Encode(author{"kitten", 3})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.SetPayload(payload)
+
+	var buf bytes.Buffer
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	codec, err = GetCodec(res.Header.SerializeType())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v := author{}
+	err = codec.Decode(res.Payload, &v)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v.Name != "kitten" || v.Age != 3 {
+		t.Fatal("json codec error")
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+
+	codec, err := GetCodec(Serialize_Protobuf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = codec.Encode(struct{}{})
+	if err != ErrNotProtoMessage {
+		t.Fatal("non proto message must return ErrNotProtoMessage")
+	}
+
+	req := NewMessage()
+	req.Header.SetSerializeType(Serialize_Protobuf)
+	payload, err := codec.Encode(&structpb.ListValue{Values: []*structpb.Value{
+		structpb.NewStringValue("kitten"),
+		structpb.NewNumberValue(3),
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.SetPayload(payload)
+
+	var buf bytes.Buffer
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	codec, err = GetCodec(res.Header.SerializeType())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v := &structpb.ListValue{}
+	err = codec.Decode(res.Payload, v)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(v.Values) != 2 || v.Values[0].GetStringValue() != "kitten" || v.Values[1].GetNumberValue() != 3 {
+		t.Fatal("protobuf codec error")
+	}
+}
+
+type metric struct {
+	Name string
+	Host string
+	Timestamp int64
+	Values []int64
+	Tags map[string]int
+}
+
+func newMetric() metric {
+	values := make([]int64, 64)
+	for i := range values {
+		values[i] = int64(i) * 1000
+	}
+	return metric{
+		Name: "cpu.usage",
+		Host: "kitten-01",
+		Timestamp: 1520000000,
+		Values: values,
+		Tags: map[string]int{"core": 8, "socket": 2},
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+
+	codec, err := GetCodec(Serialize_Msgpack)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	m := newMetric()
+	req := NewMessage()
+	req.Header.SetSerializeType(Serialize_Msgpack)
+	payload, err := codec.Encode(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.SetPayload(payload)
+
+	var buf bytes.Buffer
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	codec, err = GetCodec(res.Header.SerializeType())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v := metric{}
+	err = codec.Decode(res.Payload, &v)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v.Name != m.Name || v.Timestamp != m.Timestamp || len(v.Values) != len(m.Values) ||
+		v.Values[63] != m.Values[63] || v.Tags["core"] != 8 {
+		t.Fatal("msgpack codec error")
+	}
+}
+
+type gobMetrics struct {
+	Metric metric
+	Labels map[string]metric
+}
+
+func TestGobCodec(t *testing.T) {
+
+	codec, err := GetCodec(Serialize_Gob)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	m := gobMetrics{
+		Metric: newMetric(),
+		Labels: map[string]metric{"peak": {Name: "cpu.peak", Tags: map[string]int{"core": 1}}},
+	}
+	req := NewMessage()
+	req.Header.SetSerializeType(Serialize_Gob)
+	payload, err := codec.Encode(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.SetPayload(payload)
+
+	var buf bytes.Buffer
+	for i := 0; i < 2; i++ {
+		_, err = req.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// each message decodes by itself
+	for i := 0; i < 2; i++ {
+		res, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		codec, err = GetCodec(res.Header.SerializeType())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		v := gobMetrics{}
+		err = codec.Decode(res.Payload, &v)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if v.Metric.Name != m.Metric.Name || v.Metric.Values[63] != m.Metric.Values[63] ||
+			v.Labels["peak"].Name != "cpu.peak" || v.Labels["peak"].Tags["core"] != 1 {
+			t.Fatal("gob codec error")
+		}
+	}
+}
+
+func BenchmarkCodecSize(b *testing.B) {
+	m := newMetric()
+	for _, c := range []struct {
+		name string
+		serializeType byte
+	}{
+		{"json", Serialize_Json},
+		{"msgpack", Serialize_Msgpack},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			codec, err := GetCodec(c.serializeType)
+			if err != nil {
+				b.Fatal(err.Error())
+			}
+			var data []byte
+			for i := 0; i < b.N; i++ {
+				data, err = codec.Encode(m)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+			b.ReportMetric(float64(len(data)), "encoded-bytes")
+		})
+	}
+}
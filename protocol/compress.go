@@ -0,0 +1,259 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4/v4"
+)
+
+var (
+	ErrUnsupportedCompressType = errors.New("unsupported compress type")
+)
+
+// SetAcceptCompress set the compress types of the responses the sender of the request can uncompress
+func (message *Message) SetAcceptCompress(types ...byte) {
+	accept := make([]string, len(types))
+	for i, compressType := range types {
+		accept[i] = strconv.Itoa(int(compressType))
+	}
+	message.MetaData[Meta_Accept_Compress] = strings.Join(accept, ",")
+}
+
+// AcceptCompress report whether the sender of the request can uncompress the compress type,
+// Compress_Type_None is always accepted. without the accept meta data only the compress type
+// of the request is accepted
+func (message *Message) AcceptCompress(compressType byte) bool {
+	if compressType == Compress_Type_None {
+		return true
+	}
+	accept, ok := message.MetaData[Meta_Accept_Compress]
+	if !ok {
+		return compressType == message.Header.CompressType()
+	}
+	for _, t := range strings.Split(accept, ",") {
+		if t == strconv.Itoa(int(compressType)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compressor compress and uncompress the payload data
+type Compressor interface {
+	Zip(data []byte) ([]byte, error)
+	Unzip(data []byte) ([]byte, error)
+}
+
+// LimitUnzipper is implemented by the compressors which stop uncompressing at limit bytes
+// and return ErrMessageTooLarge, the Unzip result of other compressors is checked after uncompressing
+type LimitUnzipper interface {
+	UnzipLimit(data []byte, limit uint32) ([]byte, error)
+}
+
+var (
+	compressorLock sync.RWMutex
+	// compress type => compressor
+	compressors = map[byte]Compressor{
+		Compress_Type_Gzip: GzipCompressor{},
+		Compress_Type_Snappy: SnappyCompressor{},
+		Compress_Type_LZ4: LZ4Compressor{},
+	}
+)
+
+// RegisterCompressor register the compressor of the compress type, replace the registered one
+func RegisterCompressor(compressType byte, compressor Compressor) {
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+	compressors[compressType] = compressor
+}
+
+// get the compressor of the compress type
+func getCompressor(compressType byte) (Compressor, error) {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	compressor, ok := compressors[compressType]
+	if !ok {
+		return nil, ErrUnsupportedCompressType
+	}
+	return compressor, nil
+}
+
+// compress the payload of the message by the compress type, the gzip level of the message
+// replaces the level of the registered GzipCompressor, another registered gzip compressor is used as is
+func (message *Message) compress(compressType byte) ([]byte, error) {
+	if compressType == Compress_Type_Gzip && message.gzipCompressor != nil {
+		compressor, err := getCompressor(compressType)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := compressor.(GzipCompressor); ok {
+			return message.gzipCompressor.Zip(message.Payload)
+		}
+	}
+	return compress(compressType, message.Payload)
+}
+
+// compress payload by header compress type
+func compress(compressType byte, data []byte) ([]byte, error) {
+	if compressType == Compress_Type_None {
+		return data, nil
+	}
+	compressor, err := getCompressor(compressType)
+	if err != nil {
+		return nil, err
+	}
+	return compressor.Zip(data)
+}
+
+// uncompress payload by header compress type, return ErrMessageTooLarge
+// if the uncompressed payload exceeds limit, 0 means no limit
+func uncompress(compressType byte, data []byte, limit uint32) ([]byte, error) {
+	if compressType == Compress_Type_None {
+		return data, nil
+	}
+	compressor, err := getCompressor(compressType)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		return compressor.Unzip(data)
+	}
+	if unzipper, ok := compressor.(LimitUnzipper); ok {
+		return unzipper.UnzipLimit(data, limit)
+	}
+	data, err = compressor.Unzip(data)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) > uint64(limit) {
+		return nil, ErrMessageTooLarge
+	}
+	return data, nil
+}
+
+// read all of r, return ErrMessageTooLarge if more than limit bytes, 0 means no limit
+func readAllLimit(r io.Reader, limit uint32) ([]byte, error) {
+	if limit == 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(limit) + 1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) > uint64(limit) {
+		return nil, ErrMessageTooLarge
+	}
+	return data, nil
+}
+
+// GzipCompressor gzip compressor, register NewGzipCompressor(gzip.BestSpeed)
+// of Compress_Type_Gzip to change the level, the level only affects Zip
+type GzipCompressor struct {
+	// gzip compression level, 0 of a GzipCompressor not made by NewGzipCompressor means
+	// gzip.DefaultCompression, use NewGzipCompressor(gzip.NoCompression) to store without compression
+	Level int
+	// the level is set by NewGzipCompressor, 0 is gzip.NoCompression
+	levelSet bool
+}
+
+// NewGzipCompressor returns a GzipCompressor of the gzip level, any level including gzip.NoCompression
+func NewGzipCompressor(level int) GzipCompressor {
+	return GzipCompressor{Level: level, levelSet: true}
+}
+
+// Zip gzip compress
+func (c GzipCompressor) Zip(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 && !c.levelSet {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unzip gzip uncompress
+func (c GzipCompressor) Unzip(data []byte) ([]byte, error) {
+	return c.UnzipLimit(data, 0)
+}
+
+// UnzipLimit gzip uncompress at most limit bytes
+func (c GzipCompressor) UnzipLimit(data []byte, limit uint32) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimit(r, limit)
+}
+
+// SnappyCompressor snappy compressor
+type SnappyCompressor struct{}
+
+// Zip snappy compress
+func (c SnappyCompressor) Zip(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+// Unzip snappy uncompress
+func (c SnappyCompressor) Unzip(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// UnzipLimit snappy uncompress, the uncompressed length is checked before decoding
+func (c SnappyCompressor) UnzipLimit(data []byte, limit uint32) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && uint64(n) > uint64(limit) {
+		return nil, ErrMessageTooLarge
+	}
+	return snappy.Decode(nil, data)
+}
+
+// LZ4Compressor lz4 frame compressor
+type LZ4Compressor struct{}
+
+// Zip lz4 compress
+func (c LZ4Compressor) Zip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unzip lz4 uncompress
+func (c LZ4Compressor) Unzip(data []byte) ([]byte, error) {
+	return c.UnzipLimit(data, 0)
+}
+
+// UnzipLimit lz4 uncompress at most limit bytes
+func (c LZ4Compressor) UnzipLimit(data []byte, limit uint32) ([]byte, error) {
+	return readAllLimit(lz4.NewReader(bytes.NewReader(data)), limit)
+}
@@ -0,0 +1,232 @@
+package protocol
+
+import (
+	"testing"
+	"bytes"
+	"compress/gzip"
+	"strconv"
+)
+
+var compressTypes = []struct {
+	name string
+	compressType byte
+}{
+	{"gzip", Compress_Type_Gzip},
+	{"snappy", Compress_Type_Snappy},
+	{"lz4", Compress_Type_LZ4},
+}
+
+func TestCompress(t *testing.T) {
+
+	payload := bytes.Repeat([]byte("kitten rpc payload "), 1000)
+	for _, c := range compressTypes {
+		req := NewMessage()
+		req.Header.SetCompressType(c.compressType)
+		req.SetPayload(payload)
+
+		data, err := req.Encode()
+		if err != nil {
+			t.Fatal(c.name, err.Error())
+		}
+		if len(data) >= Header_Len+8+len(payload) {
+			t.Fatal(c.name, "payload is not compressed")
+		}
+
+		res, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(c.name, err.Error())
+		}
+		if res.Header.CompressType() != c.compressType {
+			t.Fatal(c.name, "get compress type false")
+		}
+		if !bytes.Equal(res.Payload, payload) {
+			t.Fatal(c.name, "payload data error")
+		}
+	}
+}
+
+func TestUnsupportedCompressType(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetCompressType(0x07)
+	req.SetPayload(make([]byte, Default_Compress_Threshold))
+	_, err := req.Encode()
+	if err != ErrUnsupportedCompressType {
+		t.Fatal("unregistered compress type must return ErrUnsupportedCompressType")
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+
+	RegisterCompressor(Compress_Type_Gzip, GzipCompressor{Level: gzip.BestSpeed})
+	t.Cleanup(func() {
+		RegisterCompressor(Compress_Type_Gzip, GzipCompressor{})
+	})
+
+	payload := bytes.Repeat([]byte("kitten rpc payload "), 1000)
+	req := NewMessage()
+	req.Header.SetCompressType(Compress_Type_Gzip)
+	req.SetPayload(payload)
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(data) >= Header_Len+8+len(payload) {
+		t.Fatal("payload is not compressed")
+	}
+	res, err := Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(res.Payload, payload) {
+		t.Fatal("payload data error")
+	}
+
+	_, err = GzipCompressor{Level: 10}.Zip(payload)
+	if err == nil {
+		t.Fatal("invalid gzip level must return error")
+	}
+
+	// 0 of NewGzipCompressor is gzip.NoCompression, of the zero value the default level
+	stored, err := NewGzipCompressor(gzip.NoCompression).Zip(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	zipped, err := GzipCompressor{}.Zip(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(stored) <= len(payload) || len(zipped) >= len(payload) {
+		t.Fatal("gzip level 0 must store without compression")
+	}
+
+	// the level of the message replaces the registered one
+	req.SetGzipLevel(gzip.NoCompression)
+	data, err = req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(data) <= len(payload) {
+		t.Fatal("message gzip level must be used")
+	}
+	res, err = Decode(data)
+	if err != nil || !bytes.Equal(res.Payload, payload) {
+		t.Fatal("payload of the message gzip level error")
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	payload := make([]byte, 1 << 20)
+	for i := range payload {
+		payload[i] = byte(i % 251) ^ byte(i >> 10)
+	}
+	for _, c := range compressTypes {
+		b.Run(c.name, func(b *testing.B) {
+			compressor, err := getCompressor(c.compressType)
+			if err != nil {
+				b.Fatal(err.Error())
+			}
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				data, err := compressor.Zip(payload)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+				_, err = compressor.Unzip(data)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+
+	// small payload is not compressed
+	req := NewMessage()
+	req.Header.SetCompressType(Compress_Type_Gzip)
+	req.SetPayload([]byte("kitten"))
+
+	var buf bytes.Buffer
+	_, err := req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if buf.Len() != Header_Len+8+len("kitten") {
+		t.Fatal("small payload is compressed")
+	}
+	res, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.CompressType() != Compress_Type_None {
+		t.Fatal("small payload compress type must be none")
+	}
+	if string(res.Payload) != "kitten" {
+		t.Fatal("payload data error")
+	}
+	if req.Header.CompressType() != Compress_Type_Gzip {
+		t.Fatal("request compress type must not be changed")
+	}
+
+	// large payload is compressed
+	payload := bytes.Repeat([]byte("k"), Default_Compress_Threshold)
+	req.SetPayload(payload)
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(data) >= Header_Len+8+len(payload) {
+		t.Fatal("large payload is not compressed")
+	}
+	res, err = Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.CompressType() != Compress_Type_Gzip {
+		t.Fatal("large payload compress type must be gzip")
+	}
+	if !bytes.Equal(res.Payload, payload) {
+		t.Fatal("payload data error")
+	}
+
+	// threshold 0 compress all payloads
+	req.SetPayload([]byte("kitten"))
+	req.SetCompressThreshold(0)
+	data, err = req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err = Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.CompressType() != Compress_Type_Gzip {
+		t.Fatal("threshold 0 payload compress type must be gzip")
+	}
+}
+
+func BenchmarkGzipLevel(b *testing.B) {
+	// json like payload
+	var buf bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		buf.WriteString(`{"id":` + strconv.Itoa(i) + `,"name":"kitten","tags":["rpc","go"],"score":` + strconv.Itoa(i*7%100) + `}`)
+	}
+	payload := buf.Bytes()
+	for _, level := range []int{gzip.BestSpeed, 6, gzip.BestCompression} {
+		b.Run(strconv.Itoa(level), func(b *testing.B) {
+			compressor := GzipCompressor{Level: level}
+			b.SetBytes(int64(len(payload)))
+			var size int
+			for i := 0; i < b.N; i++ {
+				data, err := compressor.Zip(payload)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "bytes/zip")
+		})
+	}
+}
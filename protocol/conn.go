@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"bufio"
+	"net"
+)
+
+// Flusher is implemented by buffered writers, the buffered bytes are written by Flush
+type Flusher interface {
+	Flush() error
+}
+
+// Conn buffered connection of framed messages, reads go through a bufio.Reader
+// and WriteMessage flushes each message with one Write.
+// Write is buffered too, the bytes are on the wire only after Flush
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// NewConn returns a new buffered Conn of the conn
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn: conn,
+		r: bufio.NewReader(conn),
+		w: bufio.NewWriter(conn),
+	}
+}
+
+// Read buffered read
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write buffered write, call Flush to write the buffered bytes to the conn
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Flush write the buffered bytes to the conn, implements Flusher
+func (c *Conn) Flush() error {
+	return c.w.Flush()
+}
+
+// WriteMessage write the framed message and flush it, return the bytes written
+func (c *Conn) WriteMessage(message *Message) (int64, error) {
+	n, err := message.WriteTo(c.w)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
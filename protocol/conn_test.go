@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"testing"
+	"bytes"
+	"net"
+)
+
+func TestConn(t *testing.T) {
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	w := NewConn(clientConn)
+	r := NewConn(serverConn)
+
+	done := make(chan error, 1)
+	go func() {
+		for seq := uint64(1); seq <= 3; seq++ {
+			msg := NewMessage()
+			msg.Header.SetSeq(seq)
+			msg.MetaData["__METHOD"] = "Author.Login"
+			msg.SetPayload([]byte("kitten"))
+			_, err := w.WriteMessage(msg)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		res, err := ReadMessage(r)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.Header.Seq() != seq || string(res.Payload) != "kitten" {
+			t.Fatal("buffered conn message error")
+		}
+	}
+	err := <-done
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// conn capturing the written bytes
+type captureConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func TestConnFlush(t *testing.T) {
+
+	raw := &captureConn{}
+	conn := NewConn(raw)
+	var flusher Flusher = conn
+
+	msg := NewMessage()
+	msg.Header.SetSeq(1)
+	msg.SetMethod("Author.Login")
+	msg.SetPayload([]byte("kitten"))
+	_, err := msg.WriteTo(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if raw.buf.Len() != 0 {
+		t.Fatal("written bytes must be buffered until Flush")
+	}
+	err = flusher.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadMessage(&raw.buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.Seq() != 1 || string(res.Payload) != "kitten" {
+		t.Fatal("flushed message error")
+	}
+
+	// WriteMessage flushes the message
+	_, err = conn.WriteMessage(msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = ReadMessage(&raw.buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// conn counting the Write calls, the syscalls of a raw conn
+type writeCountConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *writeCountConn) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+func BenchmarkConnWrite(b *testing.B) {
+	msg := NewMessage()
+	msg.Header.SetChecksum(true)
+	msg.MetaData["__METHOD"] = "Author.Login"
+	msg.SetPayload(bytes.Repeat([]byte("k"), 256))
+
+	b.Run("raw", func(b *testing.B) {
+		conn := &writeCountConn{}
+		for i := 0; i < b.N; i++ {
+			_, err := msg.WriteTo(conn)
+			if err != nil {
+				b.Fatal(err.Error())
+			}
+		}
+		b.ReportMetric(float64(conn.writes) / float64(b.N), "writes/op")
+	})
+	b.Run("buffered", func(b *testing.B) {
+		conn := &writeCountConn{}
+		bc := NewConn(conn)
+		for i := 0; i < b.N; i++ {
+			_, err := bc.WriteMessage(msg)
+			if err != nil {
+				b.Fatal(err.Error())
+			}
+		}
+		b.ReportMetric(float64(conn.writes) / float64(b.N), "writes/op")
+	})
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"strconv"
+)
+
+// error codes of RPCError
+const (
+	Err_Code_Unknown int = iota
+	Err_Code_Not_Found
+	Err_Code_Invalid_Argument
+	Err_Code_Internal
+	Err_Code_Unavailable
+	Err_Code_Method_Not_Found
+	Err_Code_Payload_Too_Large
+	Err_Code_Unauthenticated
+	Err_Code_Resource_Exhausted
+	Err_Code_Unsupported
+)
+
+// RPCError error with a code, a handler returning an RPCError sends the code and message
+// in the exception response meta and the client returns the same RPCError
+type RPCError struct {
+	Code int
+	Message string
+}
+
+// NewRPCError returns a new RPCError of the code and message
+func NewRPCError(code int, message string) *RPCError {
+	return &RPCError{Code: code, Message: message}
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// SetRPCError set the code and message of the error in the meta data
+func (message *Message) SetRPCError(err *RPCError) {
+	message.MetaData[Meta_Err_Code] = strconv.Itoa(err.Code)
+	message.MetaData[Meta_Err_Msg] = err.Message
+}
+
+// RPCError get the error of the meta data, nil if no error code
+func (message *Message) RPCError() *RPCError {
+	code, ok := message.MetaData[Meta_Err_Code]
+	if !ok {
+		return nil
+	}
+	c, err := strconv.Atoi(code)
+	if err != nil {
+		c = Err_Code_Unknown
+	}
+	return &RPCError{Code: c, Message: message.MetaData[Meta_Err_Msg]}
+}
@@ -0,0 +1,27 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestRPCError(t *testing.T) {
+
+	res := NewMessage()
+	res.SetRPCError(NewRPCError(Err_Code_Invalid_Argument, "bad args"))
+	data, err := res.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err = Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rpcErr := res.RPCError()
+	if rpcErr == nil || rpcErr.Code != Err_Code_Invalid_Argument || rpcErr.Error() != "bad args" {
+		t.Fatal("rpc error meta error")
+	}
+
+	if NewMessage().RPCError() != nil {
+		t.Fatal("message without code must have no rpc error")
+	}
+}
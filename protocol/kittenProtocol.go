@@ -1,18 +1,29 @@
 package protocol
 
 import (
+	"bufio"
 	"encoding/binary"
 	"bytes"
 	"io"
+	"io/ioutil"
 	"errors"
+	"hash"
+	"hash/crc32"
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+	"sort"
 )
 
 // kitten protocol implement
-//+---------+-----------+-----------+-------------+-------------+
-//| Header  | len(meta) | meta data | len(payload)| payload data|
-//+---------+-----------+-----------+-------------+-------------+
-//| [12]byte|  [4]byte  |           |   [4]byte   |             |
-//+-------------------------------------------------------------+
+//+---------+-----------+-----------+-------------+-------------+--------------+---------+-------------+------------+
+//| Header  | len(meta) | meta data | len(payload)| payload data| len(trailer) | trailer |    hmac     |  checksum  |
+//+---------+-----------+-----------+-------------+-------------+--------------+---------+-------------+------------+
+//| [12]byte|  [4]byte  |           |   [4]byte   |             |  [4]byte opt |   opt   | [32]byte opt| [4]byte opt|
+//+------------------------------------------------------------------------------------------------------------------+
+// trailer is meta data encoded like the meta data, only if header trailer flag is set
+// hmac is hmac-sha256 of header, meta data, payload data and trailer, only if header hmac flag is set
+// checksum is crc32 (IEEE) of meta data, payload data and trailer, only if header checksum flag is set
 
 // protocol Header
 // format:
@@ -22,22 +33,48 @@ import (
 // +------1bit----+------1bit-----+----1bit----+-----3bit-----+---------2bit-------+
 // | message type | is heart beat | is one way | compress type| message status type|
 // +--------------+---------------+------------+--------------+--------------------+
-// [3] serialize type
-// +------4bit-----+------4bit-----+
-// | serialize type|               |
-// +---------------+---------------+
+// [3] serialize type and flags
+// +------4bit-----+----1bit----+----1bit----+----1bit----+----1bit----+
+// | serialize type|  checksum  |    hmac    |  trailer   |  reserved  |
+// +---------------+------------+------------+------------+------------+
 // [4] ~ [11] sequence number messageId uint64
 
+// protocol meta data
+// every key and value is length prefixed, binary safe, a key with repeated values is repeated
+//+----------+-----+------------+-------+-----+
+//| len(key) | key | len(value) | value | ... |
+//+----------+-----+------------+-------+-----+
+//|  [4]byte |     |   [4]byte  |       |     |
+//+-------------------------------------------+
+
 var (
-	// meta sep line separator
-	lineSeparator = []byte("\r\n")
+	ErrMalformedMeta = errors.New("meta data is malformed")
+	ErrBadMagic = errors.New("bad magic number")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrShortMessage = errors.New("message data too short")
+	ErrInvalidLength = errors.New("message length exceeds data")
+	ErrChecksumMismatch = errors.New("message checksum mismatch")
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrAuthFailed = errors.New("message authentication failed")
+	ErrTooManyMetaEntries = errors.New("too many meta entries")
+	ErrPayloadTooLarge = errors.New("payload too large")
+	ErrInvalidSegment = errors.New("invalid payload segment")
 )
 
 const (
 	// header len
 	Header_Len int = 12
-	// magic number
+	// default magic number of the header, a deployment may use another one to tell its frames apart
 	MagicNumber byte = 0x08
+	// default compress threshold of new messages
+	Default_Compress_Threshold int = 512
+	// default max meta key value pairs of a read message
+	Default_Max_Meta_Entries int = 256
+	// max encoded meta bytes held at a time by WriteTo
+	Meta_Chunk_Len int = 4096
+	// supported protocol version range
+	Min_Version byte = 0
+	Max_Version byte = 0
 )
 
 const (
@@ -48,6 +85,8 @@ const (
 const (
 	Compress_Type_None byte = iota
 	Compress_Type_Gzip
+	Compress_Type_Snappy
+	Compress_Type_LZ4
 )
 
 const (
@@ -58,6 +97,42 @@ const (
 const (
 	Serialize_None byte = iota
 	Serialize_Json
+	Serialize_Protobuf
+	Serialize_Msgpack
+	Serialize_Gob
+)
+
+const (
+	// meta key of request method
+	Meta_Method = "__METHOD"
+	// meta key of request id
+	Meta_ID = "__ID"
+	// meta key of request deadline, unix nano
+	Meta_Deadline = "__DEADLINE"
+	// meta keys of the version handshake, the decimal version range the client supports
+	Meta_Min_Version = "__MIN_VERSION"
+	Meta_Max_Version = "__MAX_VERSION"
+	// meta keys of the exception response of an RPCError, the decimal code and the message
+	Meta_Err_Code = "__ERR_CODE"
+	Meta_Err_Msg = "__ERR_MSG"
+	// meta key of the heartbeat response, the server time, unix nano
+	Meta_Time = "__TIME"
+	// meta key of the compress types of the responses the client can uncompress, comma separated decimal
+	Meta_Accept_Compress = "__ACCEPT_COMPRESS"
+	// meta key of the bearer token of the request
+	Meta_Auth = "__AUTH"
+	// meta keys of the trace of the request, the trace id, the span id of the call and its parent span id
+	Meta_Trace_ID = "__TRACE_ID"
+	Meta_Span_ID = "__SPAN_ID"
+	Meta_Parent_Span = "__PARENT_SPAN"
+	// meta keys of a segment of a segmented payload, the decimal index from 0 and the total segments
+	Meta_Segment = "__SEGMENT"
+	Meta_Segments = "__SEGMENTS"
+)
+
+const (
+	// reserved method answered like a heartbeat by every server, independent of the registered handlers
+	Method_Ping = "__ping"
 )
 
 type Header [Header_Len]byte
@@ -67,22 +142,195 @@ type Message struct {
 	Header *Header
 	MetaData map[string]string
 	Payload []byte
+	// meta data written after the payload, the trailer flag is set if it is not empty
+	Trailer map[string]string
+
+	// payload shorter than compress threshold is written uncompressed, not on the wire
+	compressThreshold int
+	// gzip compressor of the level of SetGzipLevel, nil means the registered one
+	gzipCompressor *GzipCompressor
+	// repeated values of the meta keys, the first value is in MetaData
+	extraMeta map[string][]string
+	// hmac key of the written message, nil means no hmac
+	authKey []byte
+	// byte order of the written message, nil means binary.BigEndian
+	byteOrder binary.ByteOrder
+	// meta bytes buffer reused by ReadMessageInto
+	metaBuf []byte
 }
 
 // Get Message instance
 func NewMessage() *Message  {
 	header := Header([Header_Len]byte{})
 	header[0] = MagicNumber
+	return NewMessageHeader(header)
+}
+
+// NewMessageHeader returns a new message with a copy of the template header,
+// messages of the same template share no header
+func NewMessageHeader(header Header) *Message {
 	return &Message{
-		Header: &header,
+		Header: header.Clone(),
 		MetaData: make(map[string]string),
-		Payload: make([]byte, 1),
+		Payload: make([]byte, 0),
+		compressThreshold: Default_Compress_Threshold,
+	}
+}
+
+// Reset the message for reuse, the header is zeroed with the magic number,
+// meta data is cleared in place, payload is truncated to zero length,
+// the compress threshold is the default, the gzip level, auth key and byte order are removed
+func (message *Message) Reset() {
+	*message.Header = Header{}
+	message.Header[0] = MagicNumber
+	message.compressThreshold = Default_Compress_Threshold
+	message.gzipCompressor = nil
+	message.extraMeta = nil
+	message.authKey = nil
+	message.byteOrder = nil
+	if message.MetaData == nil {
+		message.MetaData = make(map[string]string)
+	}
+	for k := range message.MetaData {
+		delete(message.MetaData, k)
+	}
+	for k := range message.Trailer {
+		delete(message.Trailer, k)
+	}
+	message.Payload = message.Payload[:0]
+}
+
+// Clone deep copy the message, the clone shares no header, meta data or payload
+// with the message and is safe to keep after the message is reused
+func (message *Message) Clone() *Message {
+	clone := &Message{
+		Header: message.Header.Clone(),
+		MetaData: make(map[string]string, len(message.MetaData)),
+		Payload: append([]byte{}, message.Payload...),
+		compressThreshold: message.compressThreshold,
+		gzipCompressor: message.gzipCompressor,
+		byteOrder: message.byteOrder,
 	}
+	for k, v := range message.MetaData {
+		clone.MetaData[k] = v
+	}
+	if message.Trailer != nil {
+		clone.Trailer = make(map[string]string, len(message.Trailer))
+		for k, v := range message.Trailer {
+			clone.Trailer[k] = v
+		}
+	}
+	if message.extraMeta != nil {
+		clone.extraMeta = make(map[string][]string, len(message.extraMeta))
+		for k, v := range message.extraMeta {
+			clone.extraMeta[k] = append([]string{}, v...)
+		}
+	}
+	if message.authKey != nil {
+		clone.authKey = append([]byte{}, message.authKey...)
+	}
+	return clone
+}
+
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return NewMessage()
+	},
 }
 
-// Check magic number
+// GetMessage get a reset message from the pool
+func GetMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// PutMessage put the message back to the pool, the message must not be used after put
+func PutMessage(message *Message) {
+	message.Reset()
+	messagePool.Put(message)
+}
+
+// bit layout of the header, byte 0 is the magic number, byte 1 the version and bytes 4 to 11
+// the seq in the byte order of the message
+const (
+	// byte 2: message type, heart beat, one way, compress type and status type
+	Header_Message_Type_Mask byte = 0x80
+	Header_Message_Type_Shift uint = 7
+	Header_Heart_Beat_Mask byte = 0x40
+	Header_One_Way_Mask byte = 0x20
+	Header_Compress_Type_Mask byte = 0x1c
+	Header_Compress_Type_Shift uint = 2
+	Header_Status_Type_Mask byte = 0x03
+	// byte 3: serialize type, checksum, hmac, trailer and segment flags
+	Header_Serialize_Type_Mask byte = 0xf0
+	Header_Serialize_Type_Shift uint = 4
+	Header_Checksum_Mask byte = 0x08
+	Header_Auth_Mask byte = 0x04
+	Header_Trailer_Mask byte = 0x02
+	Header_Segment_Mask byte = 0x01
+)
+
+// HeaderFields decoded fields of a header
+type HeaderFields struct {
+	MagicNumber byte
+	Version byte
+	MessageType byte
+	HeartBeat bool
+	OneWay bool
+	CompressType byte
+	MessageStatusType byte
+	SerializeType byte
+	Checksum bool
+	Auth bool
+	Trailer bool
+	Segment bool
+	// seq of the big endian header in memory, a header read off the wire in another byte order
+	// must be converted first
+	Seq uint64
+}
+
+// DecodeHeader decode all the fields of the header, for tools parsing the frames
+func DecodeHeader(header Header) HeaderFields {
+	return HeaderFields{
+		MagicNumber: header.MagicNumber(),
+		Version: header.Version(),
+		MessageType: header.MessageType(),
+		HeartBeat: header.IsHeartBeat(),
+		OneWay: header.IsOneWay(),
+		CompressType: header.CompressType(),
+		MessageStatusType: header.MessageStatusType(),
+		SerializeType: header.SerializeType(),
+		Checksum: header.HasChecksum(),
+		Auth: header.HasAuth(),
+		Trailer: header.HasTrailer(),
+		Segment: header.IsSegment(),
+		Seq: header.Seq(),
+	}
+}
+
+// Clone returns a copy of the header, the copy shares nothing with the header.
+// copying a Message struct shares its *Header, use Message.Clone or NewMessageHeader instead
+func (header Header) Clone() *Header {
+	return &header
+}
+
+// Check magic number is the default MagicNumber
 func (header *Header) CheckMagicNumber() bool {
-	return header[0] == MagicNumber
+	return header.CheckMagic(MagicNumber)
+}
+
+// CheckMagic check magic number is the configured magic
+func (header *Header) CheckMagic(magic byte) bool {
+	return header[0] == magic
+}
+
+// Set header magic number
+func (header *Header) SetMagicNumber(magic byte) {
+	header[0] = magic
+}
+
+// Get header magic number
+func (header *Header) MagicNumber() byte {
+	return header[0]
 }
 
 // Set header version
@@ -97,74 +345,131 @@ func (header *Header) Version() byte {
 
 // Set header message type (Request or Response)
 func (header *Header) SetMessageType(messageType byte)  {
-	header[2] = header[2] | (messageType << 7)
+	header[2] = (header[2] &^ Header_Message_Type_Mask) | ((messageType << Header_Message_Type_Shift) & Header_Message_Type_Mask)
 }
 
 // Get header message type
 func (header *Header) MessageType() byte {
-	return (header[2] & 0x80) >> 7
+	return (header[2] & Header_Message_Type_Mask) >> Header_Message_Type_Shift
 }
 
 // Set heart beat
 func (header *Header) SetHeartBeat(heartBeat bool)  {
 	if heartBeat {
-		header[2] = header[2] | 0x40
+		header[2] = header[2] | Header_Heart_Beat_Mask
 	}else {
-		header[2] = header[2] &^ 0x40
+		header[2] = header[2] &^ Header_Heart_Beat_Mask
 	}
 }
 
 // Get heart beat
 func (header *Header) IsHeartBeat() bool {
-	return (header[2] & 0x40) == 0x40
+	return (header[2] & Header_Heart_Beat_Mask) == Header_Heart_Beat_Mask
 }
 
 // Set one way
 func (header *Header) SetOneWay(oneWay bool) {
 	if oneWay {
-		header[2] = header[2] | 0x20
+		header[2] = header[2] | Header_One_Way_Mask
 	}else {
-		header[2] = header[2] &^ 0x20
+		header[2] = header[2] &^ Header_One_Way_Mask
 	}
 }
 
 // Get is one way
 func (header *Header) IsOneWay() bool {
-	return (header[2] & 0x20) == 0x20
+	return (header[2] & Header_One_Way_Mask) == Header_One_Way_Mask
 }
 
 // Set compress type
 func (header *Header) SetCompressType(compressType byte) {
-	header[2] = header[2] | ((compressType << 2) & 0x1c)
+	header[2] = (header[2] &^ Header_Compress_Type_Mask) | ((compressType << Header_Compress_Type_Shift) & Header_Compress_Type_Mask)
 }
 
 // Get compress type
 func (header *Header) CompressType() byte  {
-	return (header[2] & 0x1c) >> 2
+	return (header[2] & Header_Compress_Type_Mask) >> Header_Compress_Type_Shift
 }
 
 // Set message type
 func (header *Header) SetMessageStatusType(messageType byte) {
-	header[2] = header[2] | (messageType & 0x03)
+	header[2] = (header[2] &^ Header_Status_Type_Mask) | (messageType & Header_Status_Type_Mask)
 }
 
 // Get message type
 func (header *Header) MessageStatusType() byte {
-	return header[2] & 0x03
+	return header[2] & Header_Status_Type_Mask
 }
 
 // Set serialize type
 func (header *Header) SetSerializeType(serializeType byte) {
-	header[3] = header[3] | (serializeType << 4)
+	header[3] = (header[3] &^ Header_Serialize_Type_Mask) | (serializeType << Header_Serialize_Type_Shift)
 }
 
 // Get serialize type
 func (header *Header) SerializeType() byte {
-	return (header[3] & 0xF0) >> 4
+	return (header[3] & Header_Serialize_Type_Mask) >> Header_Serialize_Type_Shift
+}
+
+// Set checksum flag
+func (header *Header) SetChecksum(checksum bool) {
+	if checksum {
+		header[3] = header[3] | Header_Checksum_Mask
+	}else {
+		header[3] = header[3] &^ Header_Checksum_Mask
+	}
+}
+
+// Get has checksum
+func (header *Header) HasChecksum() bool {
+	return (header[3] & Header_Checksum_Mask) == Header_Checksum_Mask
+}
+
+// Set hmac flag
+func (header *Header) SetAuth(auth bool) {
+	if auth {
+		header[3] = header[3] | Header_Auth_Mask
+	}else {
+		header[3] = header[3] &^ Header_Auth_Mask
+	}
+}
+
+// Get has hmac
+func (header *Header) HasAuth() bool {
+	return (header[3] & Header_Auth_Mask) == Header_Auth_Mask
+}
+
+// Set trailer flag
+func (header *Header) SetTrailer(trailer bool) {
+	if trailer {
+		header[3] = header[3] | Header_Trailer_Mask
+	}else {
+		header[3] = header[3] &^ Header_Trailer_Mask
+	}
+}
+
+// Get has trailer
+func (header *Header) HasTrailer() bool {
+	return (header[3] & Header_Trailer_Mask) == Header_Trailer_Mask
+}
+
+// Set segment flag, the message is a segment of a segmented payload
+func (header *Header) SetSegment(segment bool) {
+	if segment {
+		header[3] = header[3] | Header_Segment_Mask
+	}else {
+		header[3] = header[3] &^ Header_Segment_Mask
+	}
+}
+
+// Get is segment
+func (header *Header) IsSegment() bool {
+	return (header[3] & Header_Segment_Mask) == Header_Segment_Mask
 }
 
 // Set seq number
-// BigEndian 大端
+// BigEndian 大端, the header in memory is always big endian,
+// the seq on the wire is in the byte order of the message
 func (header *Header) SetSeq(seq uint64)  {
 	binary.BigEndian.PutUint64(header[4:], seq)
 }
@@ -174,9 +479,83 @@ func (header *Header) Seq() uint64 {
 	return binary.BigEndian.Uint64(header[4:])
 }
 
-// Set meta data
+// Set meta data, the repeated values added by AddMeta are removed
 func (message *Message) SetMetaData(meta map[string]string) {
 	message.MetaData = meta
+	message.extraMeta = nil
+}
+
+// AddMeta add the value to the key, the first value of the key is in MetaData
+// and the repeated values are encoded after it in order
+func (message *Message) AddMeta(key string, value string) {
+	if _, ok := message.MetaData[key]; !ok {
+		message.MetaData[key] = value
+		return
+	}
+	if message.extraMeta == nil {
+		message.extraMeta = make(map[string][]string)
+	}
+	message.extraMeta[key] = append(message.extraMeta[key], value)
+}
+
+// GetMeta get the first value of the key, false if the key is not in MetaData
+func (message *Message) GetMeta(key string) (string, bool) {
+	value, ok := message.MetaData[key]
+	return value, ok
+}
+
+// SetMethod set the request method in the Meta_Method meta
+func (message *Message) SetMethod(method string) {
+	message.MetaData[Meta_Method] = method
+}
+
+// Method get the request method of the Meta_Method meta, empty if not set
+func (message *Message) Method() string {
+	return message.MetaData[Meta_Method]
+}
+
+// SetID set the request id in the Meta_ID meta
+func (message *Message) SetID(id string) {
+	message.MetaData[Meta_ID] = id
+}
+
+// ID get the request id of the Meta_ID meta, empty if not set
+func (message *Message) ID() string {
+	return message.MetaData[Meta_ID]
+}
+
+// GetAll get all values of the key in order, nil if the key is not in MetaData.
+// the repeated values of a key deleted from MetaData are not encoded
+func (message *Message) GetAll(key string) []string {
+	value, ok := message.MetaData[key]
+	if !ok {
+		return nil
+	}
+	return append([]string{value}, message.extraMeta[key]...)
+}
+
+// SetByteOrder set the byte order of the seq and lengths of the written message, nil means binary.BigEndian.
+// the reader must read with the same byte order
+func (message *Message) SetByteOrder(order binary.ByteOrder) {
+	message.byteOrder = order
+}
+
+// byte order of the written message
+func (message *Message) order() binary.ByteOrder {
+	return byteOrder(message.byteOrder)
+}
+
+// the byte order, binary.BigEndian if nil
+func byteOrder(order binary.ByteOrder) binary.ByteOrder {
+	if order == nil {
+		return binary.BigEndian
+	}
+	return order
+}
+
+// convert the seq of the big endian header in memory to the byte order of the wire
+func wireSeq(header *Header, order binary.ByteOrder) {
+	order.PutUint64(header[4:], header.Seq())
 }
 
 // Set payload
@@ -184,135 +563,1061 @@ func (message *Message) SetPayload(payload []byte)  {
 	message.Payload = payload
 }
 
+// SetCompressThreshold set the min payload length to compress, 0 compress all payloads,
+// new messages use Default_Compress_Threshold
+func (message *Message) SetCompressThreshold(threshold int) {
+	message.compressThreshold = threshold
+}
+
+// SetGzipLevel set the gzip level of the written gzip payload, any level including gzip.NoCompression,
+// it replaces the level of the registered GzipCompressor. new messages use the registered compressor
+func (message *Message) SetGzipLevel(level int) {
+	compressor := NewGzipCompressor(level)
+	message.gzipCompressor = &compressor
+}
+
+// Validate check the message before writing, the magic number must be set, the version must be readable
+// and the serialize type and compress type must be registered. meta data needs no check,
+// the keys and values are length prefixed and may hold any bytes
+func (message *Message) Validate() error {
+	if message.Header.MagicNumber() == 0 {
+		return ErrBadMagic
+	}
+	err := checkHeader(message.Header, message.Header.MagicNumber())
+	if err != nil {
+		return err
+	}
+	serializeType := message.Header.SerializeType()
+	if serializeType != Serialize_None {
+		_, err = GetCodec(serializeType)
+		if err != nil {
+			return err
+		}
+	}
+	compressType := message.Header.CompressType()
+	if compressType != Compress_Type_None {
+		_, err = getCompressor(compressType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Encode message
-func (message *Message) Encode() []byte {
+// payload is compressed by header compress type
+func (message *Message) Encode() ([]byte, error) {
+	return message.EncodeInto(nil)
+}
+
+// Size returns the encoded length of the message, len(Encode()), without encoding it.
+// a payload that will be compressed is compressed to know its length, -1 is returned if
+// the message fails to encode
+func (message *Message) Size() int {
+	payloadLen := len(message.Payload)
+	if message.Header.CompressType() != Compress_Type_None && payloadLen >= message.compressThreshold {
+		_, payload, err := message.compressPayload()
+		if err != nil {
+			return -1
+		}
+		payloadLen = len(payload)
+	}
+	return message.frameLen(metaSize(message.MetaData, message.extraMeta), payloadLen)
+}
 
-	metaData := message.MetaData
-	payload := message.Payload
+// length of the frame of the message with the meta and payload lengths as written
+func (message *Message) frameLen(metaLen int, payloadLen int) int {
+	n := Header_Len + 4 + metaLen + 4 + payloadLen
+	if len(message.Trailer) > 0 {
+		n += 4 + metaSize(message.Trailer, nil)
+	}
+	if message.authKey != nil {
+		n += Auth_Len
+	}
+	if message.Header.HasChecksum() {
+		n += 4
+	}
+	return n
+}
 
-	meta := encodeMeta(metaData)
-	messageLen := Header_Len + 4 + len(meta) + 4 + len(payload)
+// EncodeInto encode the message like Encode into dst and return the encoded slice,
+// dst is resliced if its capacity is large enough, otherwise a new slice is allocated.
+// the returned slice shares the backing array of dst, it is valid until dst is reused
+func (message *Message) EncodeInto(dst []byte) ([]byte, error) {
 
-	data := make([]byte, messageLen)
-	copy(data, message.Header[:])
+	header, payload, err := message.compressPayload()
+	if err != nil {
+		return nil, err
+	}
 
-	binary.BigEndian.PutUint32(data[12:16], uint32(len(meta)))
-	copy(data[16:], meta)
+	order := message.order()
+	metaLen := metaSize(message.MetaData, message.extraMeta)
+	trailer := message.encodeTrailer(&header)
+	messageLen := message.frameLen(metaLen, len(payload))
 
-	binary.BigEndian.PutUint32(data[16+len(meta):], uint32(len(payload)))
-	copy(data[20+len(meta):], payload)
+	data := dst[:0]
+	if cap(data) < messageLen {
+		data = make([]byte, messageLen)
+	}
+	data = data[:messageLen]
+	copy(data, header[:])
+	// the header as written, in data so the header does not escape
+	wire := (*Header)(data[:Header_Len])
+	wireSeq(wire, order)
 
-	return data
+	order.PutUint32(data[12:16], uint32(metaLen))
+	meta := data[16:16+metaLen]
+	putMeta(meta, order, message.MetaData, message.extraMeta)
+
+	order.PutUint32(data[16+metaLen:], uint32(len(payload)))
+	copy(data[20+metaLen:], payload)
+
+	n := 20 + metaLen + len(payload)
+	if header.HasTrailer() {
+		order.PutUint32(data[n:], uint32(len(trailer)))
+		copy(data[n+4:], trailer)
+		n += 4 + len(trailer)
+	}
+	if header.HasAuth() {
+		copy(data[n:], authCode(message.authKey, wire, meta, payload, trailer))
+		n += Auth_Len
+	}
+	if message.Header.HasChecksum() {
+		order.PutUint32(data[n:], checksum(meta, payload, trailer))
+	}
+
+	return data, nil
 }
 
-// write to writers
-func (message *Message) WriteTo(w io.Writer) error  {
-	// write header
-	_, err := w.Write(message.Header[:])
+// Decode message from encoded data
+func Decode(data []byte) (*Message, error) {
+	return DecodeOrder(data, binary.BigEndian)
+}
+
+// DecodeOrder decode message from data encoded in the byte order
+func DecodeOrder(data []byte, order binary.ByteOrder) (*Message, error) {
+	return DecodeMagic(data, order, 0)
+}
+
+// DecodeMagic decode message from data encoded in the byte order with the magic number,
+// a message with another magic returns ErrBadMagic, 0 means MagicNumber
+func DecodeMagic(data []byte, order binary.ByteOrder, magic byte) (*Message, error) {
+	msg, _, err := decode(data, order, magic)
+	return msg, err
+}
+
+// decode message from data, return the decoded length, data may be longer than the message
+func decode(data []byte, order binary.ByteOrder, magic byte) (*Message, uint64, error) {
+	if len(data) < Header_Len + 8 {
+		return nil, 0, ErrShortMessage
+	}
+
+	msg := NewMessage()
+	copy(msg.Header[:], data[:Header_Len])
+	msg.Header.SetSeq(order.Uint64(msg.Header[4:]))
+	err := checkHeader(msg.Header, magicNumber(magic))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// meta len and meta
+	n := uint64(Header_Len)
+	metaLen := uint64(order.Uint32(data[n:]))
+	n += 4
+	if n + metaLen + 4 > uint64(len(data)) {
+		return nil, 0, ErrInvalidLength
+	}
+	metaByte := data[n:n+metaLen]
+	msg.extraMeta, err = decodeMeta(order, metaByte, msg.MetaData, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	n += metaLen
+
+	// payload len and payload
+	payloadLen := uint64(order.Uint32(data[n:]))
+	n += 4
+	if n + payloadLen > uint64(len(data)) {
+		return nil, 0, ErrInvalidLength
+	}
+
+	// copy payload, message does not share data
+	payload := make([]byte, payloadLen)
+	copy(payload, data[n:n+payloadLen])
+	n += payloadLen
+
+	// trailer len and trailer
+	var trailer []byte
+	if msg.Header.HasTrailer() {
+		if n + 4 > uint64(len(data)) {
+			return nil, 0, ErrInvalidLength
+		}
+		trailerLen := uint64(order.Uint32(data[n:]))
+		n += 4
+		if n + trailerLen > uint64(len(data)) {
+			return nil, 0, ErrInvalidLength
+		}
+		trailer = data[n:n+trailerLen]
+		msg.Trailer = make(map[string]string)
+		_, err = decodeMeta(order, trailer, msg.Trailer, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += trailerLen
+	}
+
+	// hmac is not verified without the key
+	if msg.Header.HasAuth() {
+		n += uint64(Auth_Len)
+		if n > uint64(len(data)) {
+			return nil, 0, ErrInvalidLength
+		}
+	}
+
+	// verify checksum
+	if msg.Header.HasChecksum() {
+		if n + 4 > uint64(len(data)) {
+			return nil, 0, ErrInvalidLength
+		}
+		if order.Uint32(data[n:]) != checksum(metaByte, payload, trailer) {
+			return nil, 0, ErrChecksumMismatch
+		}
+		n += 4
+	}
+
+	msg.Payload, err = uncompress(msg.Header.CompressType(), payload, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return msg, n, nil
+}
+
+// WriteTo write the framed message to the writer, return the bytes written, implements io.WriterTo
+func (message *Message) WriteTo(writer io.Writer) (int64, error) {
+	w := &countWriter{w: writer}
+	err := message.writeTo(w)
+	return w.n, err
+}
+
+// WriteAllTo write the framed message like WriteTo with a single Write of the Encode frame.
+// WriteTo writes the header and each block separately without copying the payload, it suits
+// a buffered writer like Conn. WriteAllTo suits an unbuffered transport where every Write is a syscall
+// or a packet, and writers that must see the whole frame at once
+func (message *Message) WriteAllTo(w io.Writer) error {
+	data, err := message.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadFrom read a framed message into the message like ReadMessageInto, return the bytes read.
+// it reads one message, not until io.EOF
+func (message *Message) ReadFrom(reader io.Reader) (int64, error) {
+	r := &countReader{r: reader}
+	err := ReadMessageInto(r, message)
+	return r.n, err
+}
+
+// MarshalBinary encode the message like Encode, implements encoding.BinaryMarshaler
+func (message *Message) MarshalBinary() ([]byte, error) {
+	return message.Encode()
+}
+
+// UnmarshalBinary decode data like DecodeMagic in the byte order and with the magic number of the
+// message header into the message, MagicNumber for a message without header. implements
+// encoding.BinaryUnmarshaler. data must hold exactly one whole message or ErrInvalidLength
+// is returned, the hmac is not verified
+func (message *Message) UnmarshalBinary(data []byte) error {
+	var magic byte
+	if message.Header != nil {
+		magic = message.Header.MagicNumber()
+	}
+	msg, n, err := decode(data, message.order(), magic)
 	if err != nil {
 		return err
 	}
+	if n != uint64(len(data)) {
+		return ErrInvalidLength
+	}
+	msg.byteOrder = message.byteOrder
+	*message = *msg
+	return nil
+}
+
+// WriteMessages write the framed messages back to back with one Write,
+// ReadMessage reads them one at a time. nothing is written if a message fails to encode
+func WriteMessages(w io.Writer, msgs []*Message) error {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		err := msg.writeTo(&buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
 
-	meta := encodeMeta(message.MetaData)
-	err = binary.Write(w, binary.BigEndian, uint32(len(meta)))
+// write the framed message, the meta data is written in chunks of Meta_Chunk_Len without
+// encoding it whole, the checksum and hmac are summed as the blocks are written
+func (message *Message) writeTo(w io.Writer) error {
+	header, payload, err := message.compressPayload()
 	if err != nil {
 		return err
 	}
+	trailer := message.encodeTrailer(&header)
+	order := message.order()
+	wireSeq(&header, order)
 
-	_, err = w.Write(meta)
+	// write header
+	_, err = w.Write(header[:])
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(w, binary.BigEndian, uint32(len(message.Payload)))
+	var crc hash.Hash32
+	var mac hash.Hash
+	var sums []io.Writer
+	if message.Header.HasChecksum() {
+		crc = crc32.NewIEEE()
+		sums = append(sums, crc)
+	}
+	if header.HasAuth() {
+		mac = hmac.New(sha256.New, message.authKey)
+		mac.Write(header[:])
+		sums = append(sums, mac)
+	}
+	sum := io.MultiWriter(sums...)
+
+	err = writeMeta(w, sum, order, message.MetaData, message.extraMeta)
 	if err != nil {
 		return err
 	}
 
-	_, err = w.Write(message.Payload)
+	err = writeBlock(w, order, payload)
+	if err != nil {
+		return err
+	}
+	sum.Write(payload)
+
+	if header.HasTrailer() {
+		err = writeBlock(w, order, trailer)
+		if err != nil {
+			return err
+		}
+		sum.Write(trailer)
+	}
+
+	if mac != nil {
+		_, err = w.Write(mac.Sum(nil))
+		if err != nil {
+			return err
+		}
+	}
+
+	if crc != nil {
+		err = binary.Write(w, order, crc.Sum32())
+	}
 
 	return err
 }
 
+// write the meta len and the metaData encoded like encodeMeta to w and sum, at most Meta_Chunk_Len
+// encoded bytes are held at a time
+func writeMeta(w io.Writer, sum io.Writer, order binary.ByteOrder, encodeData map[string]string, extraData map[string][]string) error {
+	metaLen := metaSize(encodeData, extraData)
+	err := binary.Write(w, order, uint32(metaLen))
+	if err != nil || metaLen == 0 {
+		return err
+	}
+
+	var small [16]string
+	keys := sortedKeys(encodeData, small[:0])
+
+	chunkLen := metaLen
+	if chunkLen > Meta_Chunk_Len {
+		chunkLen = Meta_Chunk_Len
+	}
+	chunk := make([]byte, 0, chunkLen)
+	flush := func() error {
+		sum.Write(chunk)
+		_, err := w.Write(chunk)
+		chunk = chunk[:0]
+		return err
+	}
+	put := func(k string, v string) error {
+		pairLen := 8 + len(k) + len(v)
+		if len(chunk) + pairLen > cap(chunk) && len(chunk) > 0 {
+			err := flush()
+			if err != nil {
+				return err
+			}
+		}
+		if pairLen > cap(chunk) {
+			// a pair over the chunk length is written as is
+			pair := make([]byte, pairLen)
+			putMetaPair(pair, order, k, v)
+			sum.Write(pair)
+			_, err := w.Write(pair)
+			return err
+		}
+		n := len(chunk)
+		chunk = chunk[:n + pairLen]
+		putMetaPair(chunk[n:], order, k, v)
+		return nil
+	}
+	for _, k := range keys {
+		err = put(k, encodeData[k])
+		if err != nil {
+			return err
+		}
+		for _, extra := range extraData[k] {
+			err = put(k, extra)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(chunk) > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// count the bytes written
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// count the bytes read
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// write a length prefixed block, an empty block writes only the length,
+// a zero length write blocks on synchronous writers like net.Pipe
+func writeBlock(w io.Writer, order binary.ByteOrder, data []byte) error {
+	err := binary.Write(w, order, uint32(len(data)))
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// compress payload by header compress type, return the header to write and the payload.
+// payload shorter than the compress threshold is not compressed and
+// the compress type of the returned header is Compress_Type_None.
+// the hmac flag of the returned header is set if the message has an auth key
+func (message *Message) compressPayload() (Header, []byte, error) {
+	header := *message.Header
+	header.SetAuth(message.authKey != nil)
+	if header.CompressType() != Compress_Type_None && len(message.Payload) < message.compressThreshold {
+		header.SetCompressType(Compress_Type_None)
+	}
+	payload, err := message.compress(header.CompressType())
+	if err != nil {
+		return header, nil, err
+	}
+	return header, payload, nil
+}
+
+// set the trailer flag of the written header and encode the trailer, nil if no trailer
+func (message *Message) encodeTrailer(header *Header) []byte {
+	header.SetTrailer(len(message.Trailer) > 0)
+	if !header.HasTrailer() {
+		return nil
+	}
+	return encodeMeta(message.order(), message.Trailer, nil)
+}
+
+// crc32 checksum of meta data, payload data and trailer
+func checksum(blocks ...[]byte) uint32 {
+	var sum uint32
+	for _, block := range blocks {
+		sum = crc32.Update(sum, crc32.IEEETable, block)
+	}
+	return sum
+}
+
 // encode metaData
-func encodeMeta(encodeData map[string]string) []byte {
-	var buf bytes.Buffer
+// each key and value is prefixed with its uint32 length, there is no separator so any byte
+// sequence (\r\n, \x00) is safe in keys and values. peers of the old \r\n separated meta can't read it.
+// keys are sorted so the same meta data is always the same bytes,
+// repeated values of a key are encoded as repeated pairs after the first value
+func encodeMeta(order binary.ByteOrder, encodeData map[string]string, extraData map[string][]string) []byte {
+	meta := make([]byte, metaSize(encodeData, extraData))
+	putMeta(meta, order, encodeData, extraData)
+	return meta
+}
+
+// length of the encoded metaData
+func metaSize(encodeData map[string]string, extraData map[string][]string) int {
+	n := 0
 	for k, v := range encodeData {
-		buf.WriteString(k)
-		buf.Write(lineSeparator)
-		buf.WriteString(v)
-		buf.Write(lineSeparator)
+		n += 8 + len(k) + len(v)
+		for _, extra := range extraData[k] {
+			n += 8 + len(k) + len(extra)
+		}
 	}
+	return n
+}
+
+// encode metaData like encodeMeta into meta of metaSize length
+func putMeta(meta []byte, order binary.ByteOrder, encodeData map[string]string, extraData map[string][]string) {
+	// a few keys are sorted on the stack
+	var small [16]string
+	keys := sortedKeys(encodeData, small[:0])
 
-	return buf.Bytes()
+	n := 0
+	for _, k := range keys {
+		n += putMetaPair(meta[n:], order, k, encodeData[k])
+		for _, extra := range extraData[k] {
+			n += putMetaPair(meta[n:], order, k, extra)
+		}
+	}
+}
+
+// append the keys of meta to keys in sorted order, keys of a small array of the caller
+// keeps a few keys off the heap
+func sortedKeys(meta map[string]string, keys []string) []string {
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// put a length prefixed meta key and value, return the bytes used
+func putMetaPair(meta []byte, order binary.ByteOrder, k string, v string) int {
+	order.PutUint32(meta, uint32(len(k)))
+	copy(meta[4:], k)
+	order.PutUint32(meta[4+len(k):], uint32(len(v)))
+	copy(meta[8+len(k):], v)
+	return 8 + len(k) + len(v)
+}
+
+// ReadMessage read a framed message from reader
+// ReadMessage and WriteTo are the canonical stream framing entry points.
+// io.EOF is returned untouched only when the reader is closed between messages,
+// a truncated frame returns io.ErrUnexpectedEOF
+func ReadMessage(r io.Reader) (*Message, error) {
+	return readMessage(r)
 }
 
 // read message from writer
 func readMessage(r io.Reader)(*Message, error) {
+	return ReadMessageLimited(r, 0, 0)
+}
+
+// ReadMessageLimited read a framed message like ReadMessage,
+// but return ErrMessageTooLarge before allocating if the declared
+// meta or payload length exceeds maxMeta or maxPayload, 0 means no limit.
+// maxPayload also bounds the uncompressed payload
+func ReadMessageLimited(r io.Reader, maxMeta uint32, maxPayload uint32) (*Message, error) {
+	return ReadMessageOptions(r, ReadOptions{MaxMeta: maxMeta, MaxPayload: maxPayload})
+}
 
+// ReadOptions options of reading a message, the zero value reads like ReadMessage
+type ReadOptions struct {
+	// max meta and payload length, 0 means no limit
+	MaxMeta uint32
+	MaxPayload uint32
+	// max meta key value pairs, 0 means Default_Max_Meta_Entries
+	MaxMetaEntries int
+	// hmac key, a message without hmac or with a mismatched hmac returns ErrAuthFailed,
+	// nil means the hmac is not verified
+	AuthKey []byte
+	// byte order of the seq and lengths, nil means binary.BigEndian
+	ByteOrder binary.ByteOrder
+	// expected magic number, a message with another magic returns ErrBadMagic, 0 means MagicNumber
+	MagicNumber byte
+	// max payload length of the message of the read meta data, 0 means no limit. a longer payload
+	// is discarded without reading it into memory and ErrPayloadTooLarge is returned
+	// with the header and meta data of the message, r is at the next message
+	PayloadLimit func(meta map[string]string) uint32
+}
+
+// ReadMessageOptions read a framed message like ReadMessage with the options,
+// the message is returned with ErrPayloadTooLarge over the PayloadLimit
+func ReadMessageOptions(r io.Reader, opts ReadOptions) (*Message, error) {
 	msg := NewMessage()
+	err := readMessageInto(r, msg, opts)
+	if err == ErrPayloadTooLarge {
+		return msg, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ReadMessageInto read a framed message like ReadMessage into msg, reusing its buffers:
+// meta data is cleared in place and payload grows only when its capacity is too small.
+// the caller must not retain msg.MetaData or msg.Payload across reads,
+// copy them or Clone the message first. msg is undefined if an error is returned
+func ReadMessageInto(r io.Reader, msg *Message) error {
+	msg.Reset()
+	return readMessageInto(r, msg, ReadOptions{})
+}
+
+// MessageSizes sizes of a framed message read from the wire
+type MessageSizes struct {
+	// meta and payload length prefixes, the payload is the compressed length
+	Meta uint32
+	Payload uint32
+	// length of the whole frame, including the header, prefixes, the trailer block
+	// of a message with the header trailer flag, hmac and checksum
+	Frame uint64
+}
+
+// PeekSizes peek the sizes of the next framed message without consuming it, the header
+// and meta data must fit in the buffer of r or bufio.ErrBufferFull is returned.
+// the trailer length follows the payload, the payload of a message with a trailer must fit too
+func PeekSizes(r *bufio.Reader) (MessageSizes, error) {
+	return PeekSizesOptions(r, ReadOptions{})
+}
+
+// PeekSizesOptions peek the sizes like PeekSizes in the byte order and with the magic number of the options
+func PeekSizesOptions(r *bufio.Reader, opts ReadOptions) (MessageSizes, error) {
+	order := byteOrder(opts.ByteOrder)
+	sizes := MessageSizes{}
+	data, err := r.Peek(Header_Len + 4)
+	if err != nil {
+		return sizes, err
+	}
+	header := new(Header)
+	copy(header[:], data)
+	err = checkHeader(header, magicNumber(opts.MagicNumber))
+	if err != nil {
+		return sizes, err
+	}
+	sizes.Meta = order.Uint32(data[Header_Len:])
+
+	if uint64(sizes.Meta) + uint64(Header_Len + 8) > uint64(r.Size()) {
+		return sizes, bufio.ErrBufferFull
+	}
+	n := Header_Len + 4 + int(sizes.Meta)
+	data, err = r.Peek(n + 4)
+	if err != nil {
+		return sizes, unexpectedEOF(err)
+	}
+	sizes.Payload = order.Uint32(data[n:])
+
+	sizes.Frame = uint64(n) + 4 + uint64(sizes.Payload)
+	if header.HasTrailer() {
+		if sizes.Frame + 4 > uint64(r.Size()) {
+			return sizes, bufio.ErrBufferFull
+		}
+		data, err = r.Peek(int(sizes.Frame) + 4)
+		if err != nil {
+			return sizes, unexpectedEOF(err)
+		}
+		sizes.Frame += 4 + uint64(order.Uint32(data[sizes.Frame:]))
+	}
+	if header.HasAuth() {
+		sizes.Frame += uint64(Auth_Len)
+	}
+	if header.HasChecksum() {
+		sizes.Frame += 4
+	}
+	return sizes, nil
+}
+
+// read a framed message into msg with the options
+func readMessageInto(r io.Reader, msg *Message, opts ReadOptions) error {
+	err := readHeader(r, msg.Header, opts)
+	if err != nil {
+		return err
+	}
+	return readBody(r, msg, opts)
+}
+
+// ReadHeader read only the header of the next framed message, the meta data and payload are left on r.
+// ReadHeader must be paired with ReadBody or SkipBody before the next message is read from r.
+// io.EOF is returned untouched only when the reader is closed between messages
+func ReadHeader(r io.Reader) (*Header, error) {
+	return ReadHeaderOptions(r, ReadOptions{})
+}
+
+// ReadHeaderOptions read only the header like ReadHeader with the byte order and magic number of the options,
+// the rest is read by ReadBodyOptions or SkipBodyOptions with the same options
+func ReadHeaderOptions(r io.Reader, opts ReadOptions) (*Header, error) {
+	header := new(Header)
+	err := readHeader(r, header, opts)
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
 
-	// read header
-	_, err := io.ReadFull(r, msg.Header[:])
+// ReadBody read the rest of the message of the header read by ReadHeader like ReadMessage
+func ReadBody(r io.Reader, header *Header) (*Message, error) {
+	return ReadBodyOptions(r, header, ReadOptions{})
+}
+
+// ReadBodyOptions read the rest of the message of the header read by ReadHeaderOptions like ReadMessageOptions,
+// the message is returned with ErrPayloadTooLarge over the PayloadLimit
+func ReadBodyOptions(r io.Reader, header *Header, opts ReadOptions) (*Message, error) {
+	msg := NewMessageHeader(*header)
+	err := readBody(r, msg, opts)
+	if err == ErrPayloadTooLarge {
+		return msg, err
+	}
 	if err != nil {
 		return nil, err
 	}
+	return msg, nil
+}
+
+// SkipBody discard the rest of the message of the header read by ReadHeader,
+// r is at the next message. the hmac and checksum are not verified
+func SkipBody(r io.Reader, header *Header) error {
+	return SkipBodyOptions(r, header, ReadOptions{})
+}
 
-	// read meta len and meta
+// SkipBodyOptions discard the rest of the message like SkipBody in the byte order of the options
+func SkipBodyOptions(r io.Reader, header *Header, opts ReadOptions) error {
+	order := byteOrder(opts.ByteOrder)
+	blocks := 2
+	if header.HasTrailer() {
+		blocks++
+	}
 	lenData := make([]byte, 4)
-	msg.MetaData, err = decodeMeta(lenData, r)
+	for i := 0; i < blocks; i++ {
+		// meta, payload and trailer
+		_, err := io.ReadFull(r, lenData)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		_, err = io.CopyN(ioutil.Discard, r, int64(order.Uint32(lenData)))
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	var trailer int64
+	if header.HasAuth() {
+		trailer += int64(Auth_Len)
+	}
+	if header.HasChecksum() {
+		trailer += 4
+	}
+	_, err := io.CopyN(ioutil.Discard, r, trailer)
+	return unexpectedEOF(err)
+}
+
+// discard the payload of length l over the payload limit and the rest of the message, the hmac and
+// checksum are verified while discarding. return ErrPayloadTooLarge if the message is intact
+func skipPayload(r io.Reader, msg *Message, opts ReadOptions, metaByte []byte, l uint32) error {
+	order := byteOrder(opts.ByteOrder)
+	var mac hash.Hash
+	if opts.AuthKey != nil {
+		if !msg.Header.HasAuth() {
+			return ErrAuthFailed
+		}
+		// the hmac covers the header as written
+		header := *msg.Header
+		wireSeq(&header, order)
+		mac = hmac.New(sha256.New, opts.AuthKey)
+		mac.Write(header[:])
+		mac.Write(metaByte)
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(metaByte)
+	var w io.Writer = crc
+	if mac != nil {
+		w = io.MultiWriter(crc, mac)
+	}
+	_, err := io.CopyN(w, r, int64(l))
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	trailer, err := readTrailer(r, order, msg, opts.MaxMeta, opts.MaxMetaEntries)
+	if err != nil {
+		return err
+	}
+	w.Write(trailer)
+
+	if msg.Header.HasAuth() {
+		code := make([]byte, Auth_Len)
+		_, err = io.ReadFull(r, code)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if mac != nil && !hmac.Equal(code, mac.Sum(nil)) {
+			return ErrAuthFailed
+		}
+	}
+	if msg.Header.HasChecksum() {
+		lenData := make([]byte, 4)
+		_, err = io.ReadFull(r, lenData)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if order.Uint32(lenData) != crc.Sum32() {
+			return ErrChecksumMismatch
+		}
+	}
+	msg.Payload = msg.Payload[:0]
+	return ErrPayloadTooLarge
+}
+
+// read the meta data, payload, hmac and checksum of the message of the read header
+func readBody(r io.Reader, msg *Message, opts ReadOptions) error {
+	order := byteOrder(opts.ByteOrder)
+
+	metaByte, err := readMeta(r, order, msg, opts.MaxMeta, opts.MaxMetaEntries)
+	if err != nil {
+		return err
+	}
+	maxPayload := opts.MaxPayload
+
+	// read payload len and payload, discard the payload over the limit of the meta data
+	lenData := make([]byte, 4)
+	payloadLen, err := readLength(lenData, r, order, maxPayload)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if opts.PayloadLimit != nil {
+		limit := opts.PayloadLimit(msg.MetaData)
+		if limit > 0 && payloadLen > limit {
+			return skipPayload(r, msg, opts, metaByte, payloadLen)
+		}
+	}
+	payload, err := readData(r, payloadLen, msg.Payload)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	// read trailer len and trailer, bounded like the meta data
+	trailer, err := readTrailer(r, order, msg, opts.MaxMeta, opts.MaxMetaEntries)
+	if err != nil {
+		return err
+	}
+
+	// read and verify hmac
+	if msg.Header.HasAuth() {
+		code := make([]byte, Auth_Len)
+		_, err = io.ReadFull(r, code)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		// the hmac covers the header as written
+		header := *msg.Header
+		wireSeq(&header, order)
+		if opts.AuthKey != nil && !hmac.Equal(code, authCode(opts.AuthKey, &header, metaByte, payload, trailer)) {
+			return ErrAuthFailed
+		}
+	}else if opts.AuthKey != nil {
+		return ErrAuthFailed
+	}
+
+	// read and verify checksum
+	if msg.Header.HasChecksum() {
+		_, err = io.ReadFull(r, lenData)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if order.Uint32(lenData) != checksum(metaByte, payload, trailer) {
+			return ErrChecksumMismatch
+		}
+	}
+
+	// uncompress payload by compress type, maxPayload bounds the uncompressed payload too
+	msg.Payload, err = uncompress(msg.Header.CompressType(), payload, maxPayload)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// the frame is truncated if reader closed after the header
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// read the header and meta data of a message into the reset msg with the options, return the meta bytes
+func readHead(r io.Reader, msg *Message, opts ReadOptions) ([]byte, error) {
+	err := readHeader(r, msg.Header, opts)
 	if err != nil {
 		return nil, err
 	}
+	return readMeta(r, byteOrder(opts.ByteOrder), msg, opts.MaxMeta, opts.MaxMetaEntries)
+}
 
-	// read payload len
-	_, err = io.ReadFull(r, lenData)
+// read and check the header against the magic number of the options,
+// the seq is converted from the byte order to the big endian header in memory
+func readHeader(r io.Reader, header *Header, opts ReadOptions) error {
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return err
+	}
+	header.SetSeq(byteOrder(opts.ByteOrder).Uint64(header[4:]))
+	return checkHeader(header, magicNumber(opts.MagicNumber))
+}
+
+// read the meta len and meta data into the reset msg, return the meta bytes
+func readMeta(r io.Reader, order binary.ByteOrder, msg *Message, maxMeta uint32, maxEntries int) ([]byte, error) {
+	lenData := make([]byte, 4)
+	metaByte, err := readBlockInto(lenData, r, order, maxMeta, msg.metaBuf)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	msg.metaBuf = metaByte
+	msg.extraMeta, err = decodeMeta(order, metaByte, msg.MetaData, maxEntries)
 	if err != nil {
 		return nil, err
 	}
-	l := binary.BigEndian.Uint32(lenData)
-	msg.Payload = make([]byte, l)
+	return metaByte, nil
+}
 
-	_, err = io.ReadFull(r, msg.Payload)
+// read the trailer len and trailer into msg.Trailer if the header trailer flag is set, return the trailer bytes
+func readTrailer(r io.Reader, order binary.ByteOrder, msg *Message, maxMeta uint32, maxEntries int) ([]byte, error) {
+	if !msg.Header.HasTrailer() {
+		return nil, nil
+	}
+	lenData := make([]byte, 4)
+	trailer, err := readBlockInto(lenData, r, order, maxMeta, nil)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if msg.Trailer == nil {
+		msg.Trailer = make(map[string]string)
+	}
+	_, err = decodeMeta(order, trailer, msg.Trailer, maxEntries)
 	if err != nil {
 		return nil, err
 	}
+	return trailer, nil
+}
 
-	return msg, nil
+// read a length prefixed block into buf, buf grows only when its capacity is too small
+func readBlockInto(lenData []byte, r io.Reader, order binary.ByteOrder, limit uint32, buf []byte) ([]byte, error) {
+	l, err := readLength(lenData, r, order, limit)
+	if err != nil {
+		return nil, err
+	}
+	return readData(r, l, buf)
 }
 
-// decode metaData
-func decodeMeta(lenData []byte, r io.Reader) (map[string]string, error) {
+// max length of a read block, the max int of the platform, a longer uint32 length overflows int on 32-bit builds
+var maxBlockLen = uint64(^uint(0) >> 1)
 
-	// read len meta
+// read a block length, ErrMessageTooLarge if it exceeds the limit, 0 means no limit,
+// or the platform max block length
+func readLength(lenData []byte, r io.Reader, order binary.ByteOrder, limit uint32) (uint32, error) {
 	_, err := io.ReadFull(r, lenData)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	// to uint32
-	metaLen := binary.BigEndian.Uint32(lenData)
-	if metaLen == 0 {
-		return nil, err
+	l := order.Uint32(lenData)
+	if limit > 0 && l > limit || uint64(l) > maxBlockLen {
+		return 0, ErrMessageTooLarge
 	}
+	return l, nil
+}
 
-	metaByte := make([]byte, metaLen)
-	_, err = io.ReadFull(r, metaByte)
+// read a block of length l into buf, buf grows only when its capacity is too small
+func readData(r io.Reader, l uint32, buf []byte) ([]byte, error) {
+	data := buf[:0]
+	if uint32(cap(data)) < l {
+		data = make([]byte, l)
+	}
+	data = data[:l]
+	_, err := io.ReadFull(r, data)
 	if err != nil {
 		return nil, err
 	}
+	return data, nil
+}
 
-	metaData := bytes.Split(metaByte, lineSeparator)
-	if len(metaData) % 2 != 1 {
-		return nil, errors.New("last element is empty!")
+// the magic number, MagicNumber if 0
+func magicNumber(magic byte) byte {
+	if magic == 0 {
+		return MagicNumber
 	}
+	return magic
+}
 
-	meta := make(map[string]string)
-	for i := 0; i < len(metaData) - 1; i = i+2 {
-		key := string(metaData[i])
-		val := string(metaData[i+1])
+// check the header magic number and version before trusting the lengths
+func checkHeader(header *Header, magic byte) error {
+	if !header.CheckMagic(magic) {
+		return ErrBadMagic
+	}
+	if header.Version() < Min_Version || header.Version() > Max_Version {
+		return ErrUnsupportedVersion
+	}
+	return nil
+}
+
+// decode metaData into the empty meta, the first value of a key is in meta
+// and the repeated values in the returned extra. ErrTooManyMetaEntries is returned
+// at the pair after maxEntries pairs, 0 means Default_Max_Meta_Entries
+func decodeMeta(order binary.ByteOrder, metaByte []byte, meta map[string]string, maxEntries int) (map[string][]string, error) {
+	if maxEntries == 0 {
+		maxEntries = Default_Max_Meta_Entries
+	}
+	var extra map[string][]string
+	for entries := 0; len(metaByte) > 0; entries++ {
+		if entries == maxEntries {
+			return nil, ErrTooManyMetaEntries
+		}
+		key, n, err := readMetaField(order, metaByte)
+		if err != nil {
+			return nil, err
+		}
+		metaByte = metaByte[n:]
+
+		val, n, err := readMetaField(order, metaByte)
+		if err != nil {
+			return nil, err
+		}
+		metaByte = metaByte[n:]
 
-		meta[key] = val
+		if _, ok := meta[key]; !ok {
+			meta[key] = val
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string][]string)
+		}
+		extra[key] = append(extra[key], val)
 	}
 
-	return meta, nil
-}
\ No newline at end of file
+	return extra, nil
+}
+
+// read a length prefixed meta field, return field and bytes used
+func readMetaField(order binary.ByteOrder, data []byte) (string, int, error) {
+	if len(data) < 4 {
+		return "", 0, ErrMalformedMeta
+	}
+	l := order.Uint32(data)
+	if uint64(l) > uint64(len(data) - 4) {
+		return "", 0, ErrMalformedMeta
+	}
+	return string(data[4:4+l]), 4 + int(l), nil
+}
@@ -2,7 +2,18 @@ package protocol
 
 import (
 	"testing"
+	"bufio"
 	"bytes"
+	"encoding"
+	"encoding/binary"
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"runtime"
+	"net"
+	"time"
 )
 
 func TestMessage(t *testing.T) {
@@ -31,7 +42,7 @@ func TestMessage(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err := req.WriteTo(&buf)
+	_, err := req.WriteTo(&buf)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
@@ -86,3 +97,1688 @@ func TestMessage(t *testing.T) {
 		t.Fatal("payload data error")
 	}
 }
+
+func TestMessageGzip(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetCompressType(Compress_Type_Gzip)
+	req.Header.SetSeq(1)
+
+	payload := bytes.Repeat([]byte("kitten rpc payload "), 1000)
+	req.SetPayload(payload)
+
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(data) >= Header_Len+8+len(payload) {
+		t.Fatal("payload is not compressed")
+	}
+
+	var buf bytes.Buffer
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("write to data not equal encode data")
+	}
+
+	res, err := readMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if res.Header.CompressType() != Compress_Type_Gzip {
+		t.Fatal("get compress type false")
+	}
+
+	if !bytes.Equal(res.Payload, payload) {
+		t.Fatal("payload data error")
+	}
+}
+
+func TestDecode(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetMessageType(Message_Type_Request)
+	req.Header.SetSerializeType(Serialize_Json)
+	req.Header.SetSeq(987654321)
+	req.SetMetaData(map[string]string{"__METHOD": "Author.Login"})
+	req.SetPayload([]byte(`{"A": 1}`))
+
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if res.Header.Seq() != 987654321 {
+		t.Fatal("get seq number false")
+	}
+	if res.Header.SerializeType() != Serialize_Json {
+		t.Fatal("get serialize false")
+	}
+	if res.MetaData["__METHOD"] != "Author.Login" {
+		t.Fatal("meta data error")
+	}
+	if string(res.Payload) != `{"A": 1}` {
+		t.Fatal("payload data error")
+	}
+
+	_, err = Decode(data[:Header_Len+4])
+	if err != ErrShortMessage {
+		t.Fatal("short data must return ErrShortMessage")
+	}
+
+	_, err = Decode(data[:len(data)-1])
+	if err != ErrInvalidLength {
+		t.Fatal("truncated data must return ErrInvalidLength")
+	}
+
+	bad := append([]byte{}, data...)
+	bad[0] = 0x00
+	_, err = Decode(bad)
+	if err != ErrBadMagic {
+		t.Fatal("bad magic must return ErrBadMagic")
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+
+	req := NewMessage()
+	if len(req.Payload) != 0 {
+		t.Fatal("new message payload must be empty")
+	}
+
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(data) != Header_Len+8 {
+		t.Fatal("empty message encode length false")
+	}
+	if binary.BigEndian.Uint32(data[Header_Len+4:]) != 0 {
+		t.Fatal("empty message payload length must be 0")
+	}
+
+	var buf bytes.Buffer
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("write to data must equal encode data")
+	}
+
+	res, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res.Payload) != 0 {
+		t.Fatal("decoded payload must be empty")
+	}
+	if res.MetaData == nil {
+		t.Fatal("decoded meta data must not be nil")
+	}
+	res.MetaData["__METHOD"] = "Author.Login"
+
+	res, err = Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.MetaData == nil {
+		t.Fatal("decoded meta data must not be nil")
+	}
+	res.MetaData["__METHOD"] = "Author.Login"
+}
+
+func TestWriteEmptyPipe(t *testing.T) {
+
+	w, r := net.Pipe()
+	defer w.Close()
+	defer r.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewMessage().WriteTo(w)
+		done <- err
+	}()
+	_, err := ReadMessage(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write empty message must not block after the frame is read")
+	}
+}
+
+func TestReadMessageHeader(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetSeq(1)
+	req.SetPayload([]byte("kitten"))
+
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	bad := append([]byte{}, data...)
+	bad[0] = 0xff
+	_, err = ReadMessage(bytes.NewReader(bad))
+	if err != ErrBadMagic {
+		t.Fatal("corrupt first byte must return ErrBadMagic")
+	}
+
+	bad = append([]byte{}, data...)
+	bad[1] = Max_Version + 1
+	_, err = ReadMessage(bytes.NewReader(bad))
+	if err != ErrUnsupportedVersion {
+		t.Fatal("unknown version must return ErrUnsupportedVersion")
+	}
+	_, err = Decode(bad)
+	if err != ErrUnsupportedVersion {
+		t.Fatal("decode unknown version must return ErrUnsupportedVersion")
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+
+	var buf bytes.Buffer
+	for seq := uint64(1); seq <= 3; seq++ {
+		msg := NewMessage()
+		msg.Header.SetSeq(seq)
+		msg.Header.SetChecksum(seq == 1)
+		msg.SetAuthKey([]byte("kitten secret"))
+		msg.MetaData["__METHOD"] = "Author.Login"
+		msg.SetPayload([]byte("kitten"))
+		_, err := msg.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// skip the first message
+	header, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if header.Seq() != 1 {
+		t.Fatal("read header seq error")
+	}
+	err = SkipBody(&buf, header)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// read the body of the second message
+	header, err = ReadHeader(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	msg, err := ReadBody(&buf, header)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Header.Seq() != 2 || msg.MetaData["__METHOD"] != "Author.Login" || string(msg.Payload) != "kitten" {
+		t.Fatal("read body error")
+	}
+
+	msg, err = ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Header.Seq() != 3 {
+		t.Fatal("read message after skip body error")
+	}
+
+	_, err = ReadHeader(&buf)
+	if err != io.EOF {
+		t.Fatal("read header of closed reader must return io.EOF")
+	}
+}
+
+func TestPeekSizes(t *testing.T) {
+
+	msg := NewMessage()
+	msg.Header.SetChecksum(true)
+	msg.MetaData["__METHOD"] = "Author.Login"
+	msg.SetPayload([]byte("kitten"))
+	meta := encodeMeta(binary.BigEndian, msg.MetaData, nil)
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	sizes, err := PeekSizes(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if sizes.Meta != uint32(len(meta)) || sizes.Payload != uint32(len("kitten")) || sizes.Frame != uint64(len(data)) {
+		t.Fatal("peek sizes error")
+	}
+
+	// the message is not consumed
+	res, err := ReadMessage(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(res.Payload) != "kitten" {
+		t.Fatal("peek sizes must not consume the message")
+	}
+
+	// meta larger than the buffer
+	msg.MetaData["large"] = string(make([]byte, 64))
+	data, err = msg.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = PeekSizes(bufio.NewReaderSize(bytes.NewReader(data), 16))
+	if err != bufio.ErrBufferFull {
+		t.Fatal("meta larger than the buffer must return bufio.ErrBufferFull")
+	}
+
+	// the trailer block is in the frame
+	delete(msg.MetaData, "large")
+	msg.Trailer = map[string]string{"status": "done"}
+	data, err = msg.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sizes, err = PeekSizes(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if sizes.Frame != uint64(len(data)) {
+		t.Fatal("frame must include the trailer")
+	}
+	// the buffer ends before the trailer length prefix
+	size := Header_Len + 8 + int(sizes.Meta) + int(sizes.Payload)
+	_, err = PeekSizes(bufio.NewReaderSize(bytes.NewReader(data), size))
+	if err != bufio.ErrBufferFull {
+		t.Fatal("trailer prefix out of the buffer must return bufio.ErrBufferFull")
+	}
+}
+
+func TestReadOptionsByteOrder(t *testing.T) {
+
+	opts := ReadOptions{ByteOrder: binary.LittleEndian}
+	msg := NewMessage()
+	msg.SetByteOrder(binary.LittleEndian)
+	msg.Header.SetSeq(0x0102)
+	msg.Header.SetChecksum(true)
+	msg.MetaData["__METHOD"] = "Author.Login"
+	msg.Trailer = map[string]string{"status": "done"}
+	msg.SetPayload([]byte("kitten"))
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	frames := append(append([]byte{}, data...), data...)
+
+	sizes, err := PeekSizesOptions(bufio.NewReader(bytes.NewReader(data)), opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if sizes.Payload != uint32(len("kitten")) || sizes.Frame != uint64(len(data)) {
+		t.Fatal("peek sizes in the byte order error")
+	}
+
+	r := bytes.NewReader(frames)
+	header, err := ReadHeaderOptions(r, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if header.Seq() != 0x0102 {
+		t.Fatal("header seq in the byte order error")
+	}
+	err = SkipBodyOptions(r, header, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	header, err = ReadHeaderOptions(r, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadBodyOptions(r, header, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(res.Payload) != "kitten" || res.Trailer["status"] != "done" || r.Len() != 0 {
+		t.Fatal("read body in the byte order error")
+	}
+
+	res, payload, err := ReadStreamOptions(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, err := ioutil.ReadAll(payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(body) != "kitten" || res.Trailer["status"] != "done" {
+		t.Fatal("read stream in the byte order error")
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetSeq(7)
+	req.Header.SetChecksum(true)
+	req.SetAuthKey([]byte("kitten secret"))
+	req.MetaData["__METHOD"] = "Author.Login"
+	req.SetPayload([]byte("kitten"))
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var buf bytes.Buffer
+	var w io.WriterTo = req
+	n, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != int64(len(data)) || n != int64(buf.Len()) {
+		t.Fatal("write to bytes written error")
+	}
+
+	res := NewMessage()
+	var r io.ReaderFrom = res
+	n, err = r.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != int64(len(data)) {
+		t.Fatal("read from bytes read error")
+	}
+	if res.Header.Seq() != 7 || string(res.Payload) != "kitten" {
+		t.Fatal("read from message error")
+	}
+}
+
+// count the Write calls
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWriteAllTo(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetSeq(3)
+	req.Header.SetChecksum(true)
+	req.SetMethod("Author.Login")
+	req.SetPayload([]byte("kitten"))
+	req.Trailer = map[string]string{"status": "done"}
+
+	w := &writeCounter{}
+	err := req.WriteAllTo(w)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if w.writes != 1 {
+		t.Fatal("frame must be written once")
+	}
+
+	var buf bytes.Buffer
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(w.Bytes(), buf.Bytes()) {
+		t.Fatal("write all to and write to must be the same frame")
+	}
+}
+
+func TestWriteMessages(t *testing.T) {
+
+	msgs := make([]*Message, 3)
+	for i := range msgs {
+		msgs[i] = NewMessage()
+		msgs[i].Header.SetSeq(uint64(i + 1))
+		msgs[i].Header.SetChecksum(i == 1)
+		msgs[i].MetaData["__METHOD"] = "Author.Login"
+		msgs[i].SetPayload(bytes.Repeat([]byte("k"), i * Default_Compress_Threshold))
+		msgs[i].Header.SetCompressType(Compress_Type_Gzip)
+	}
+
+	w := &writeCounter{}
+	err := WriteMessages(w, msgs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if w.writes != 1 {
+		t.Fatal("batch must be written once")
+	}
+	for i := range msgs {
+		res, err := ReadMessage(w)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.Header.Seq() != uint64(i + 1) || !bytes.Equal(res.Payload, msgs[i].Payload) {
+			t.Fatal("batch message error")
+		}
+	}
+	_, err = ReadMessage(w)
+	if err != io.EOF {
+		t.Fatal("batch must have 3 messages")
+	}
+}
+
+func TestReadMessageEOF(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetSeq(1)
+	req.SetPayload([]byte("kitten"))
+
+	var buf bytes.Buffer
+	_, err := req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := buf.Bytes()
+
+	// clean close between messages
+	r := bytes.NewReader(data)
+	_, err = ReadMessage(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = ReadMessage(r)
+	if err != io.EOF {
+		t.Fatal("clean close must return io.EOF")
+	}
+
+	// truncated frame after header
+	_, err = ReadMessage(bytes.NewReader(data[:Header_Len]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("truncated frame must return io.ErrUnexpectedEOF")
+	}
+
+	// truncated frame in payload
+	_, err = ReadMessage(bytes.NewReader(data[:len(data)-1]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("truncated frame must return io.ErrUnexpectedEOF")
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	msg := NewMessage()
+	msg.Header.SetSerializeType(Serialize_Json)
+	msg.Header.SetCompressType(Compress_Type_Gzip)
+	msg.MetaData["key\r\n"] = "value\r\n"
+	err := msg.Validate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	msg = NewMessage()
+	msg.Header[0] = 0
+	if msg.Validate() != ErrBadMagic {
+		t.Fatal("zero magic number must return ErrBadMagic")
+	}
+
+	msg = NewMessage()
+	msg.Header.SetVersion(Max_Version + 1)
+	if msg.Validate() != ErrUnsupportedVersion {
+		t.Fatal("unsupported version must return ErrUnsupportedVersion")
+	}
+
+	msg = NewMessage()
+	msg.Header.SetSerializeType(0x0e)
+	if msg.Validate() != ErrUnsupportedSerializeType {
+		t.Fatal("unknown serialize type must return ErrUnsupportedSerializeType")
+	}
+
+	msg = NewMessage()
+	msg.Header.SetCompressType(0x07)
+	if msg.Validate() != ErrUnsupportedCompressType {
+		t.Fatal("unknown compress type must return ErrUnsupportedCompressType")
+	}
+}
+
+func TestSetCompressType(t *testing.T) {
+
+	header := NewMessage().Header
+	header.SetCompressType(Compress_Type_Gzip)
+	if header.CompressType() != Compress_Type_Gzip {
+		t.Fatal("get compress type false")
+	}
+
+	header.SetCompressType(Compress_Type_None)
+	if header.CompressType() != Compress_Type_None {
+		t.Fatal("compress type is not overwritten")
+	}
+}
+
+func TestSetMessageType(t *testing.T) {
+
+	header := NewMessage().Header
+	header.SetMessageType(Message_Type_Response)
+	if header.MessageType() != Message_Type_Response {
+		t.Fatal("get message type false")
+	}
+
+	header.SetMessageType(Message_Type_Request)
+	if header.MessageType() != Message_Type_Request {
+		t.Fatal("message type is not overwritten")
+	}
+}
+
+func TestSetSerializeType(t *testing.T) {
+
+	header := NewMessage().Header
+	header.SetSerializeType(Serialize_Json)
+	if header.SerializeType() != Serialize_Json {
+		t.Fatal("get serialize false")
+	}
+
+	header.SetSerializeType(Serialize_None)
+	if header.SerializeType() != Serialize_None {
+		t.Fatal("serialize type is not overwritten")
+	}
+}
+
+func TestSetMessageStatusType(t *testing.T) {
+
+	header := NewMessage().Header
+	header.SetMessageStatusType(Message_Status_Exception)
+	if header.MessageStatusType() != Message_Status_Exception {
+		t.Fatal("get message status false")
+	}
+
+	header.SetMessageStatusType(Message_Status_Normal)
+	if header.MessageStatusType() != Message_Status_Normal {
+		t.Fatal("message status is not overwritten")
+	}
+}
+
+func TestBinaryMeta(t *testing.T) {
+
+	meta := map[string]string{
+		"trailer": "Content-Type: text/plain\r\nX-Kitten: 1\r\n",
+		"stack":   "main.go:10\nmain.go:20\n",
+		"null":    "a\x00b\x00",
+		"empty":   "",
+		"":        "empty key",
+	}
+
+	req := NewMessage()
+	req.SetMetaData(meta)
+
+	var buf bytes.Buffer
+	_, err := req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := readMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(res.MetaData) != len(meta) {
+		t.Fatal("meta data len error")
+	}
+	for k, v := range meta {
+		val, ok := res.MetaData[k]
+		if !ok || val != v {
+			t.Fatalf("meta data %q error", k)
+		}
+	}
+}
+
+func TestTrailer(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetChecksum(true)
+	req.SetAuthKey([]byte("kitten secret"))
+	req.MetaData["__METHOD"] = "Author.Login"
+	req.SetPayload([]byte("kitten"))
+	plain, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req.Trailer = map[string]string{"status": "ok", "rows": "3"}
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(data) != len(plain) + 4 + len(encodeMeta(binary.BigEndian, req.Trailer, nil)) {
+		t.Fatal("encoded trailer length error")
+	}
+	var buf bytes.Buffer
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("write to and encode must be the same bytes")
+	}
+
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadMessageOptions(&buf, ReadOptions{AuthKey: []byte("kitten secret")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, m := range []*Message{decoded, res} {
+		if !m.Header.HasTrailer() || m.MetaData["__METHOD"] != "Author.Login" || string(m.Payload) != "kitten" {
+			t.Fatal("message with trailer error")
+		}
+		if len(m.Trailer) != 2 || m.Trailer["status"] != "ok" || m.Trailer["rows"] != "3" {
+			t.Fatal("trailer error")
+		}
+	}
+
+	// the trailer is covered by the checksum
+	data[len(data) - 4 - Auth_Len - 1] ^= 0xff
+	_, err = Decode(data)
+	if err != ErrChecksumMismatch {
+		t.Fatal("corrupted trailer must return ErrChecksumMismatch")
+	}
+
+	// no trailer, no flag and no trailer bytes
+	req.Trailer = map[string]string{}
+	data, err = req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(data, plain) {
+		t.Fatal("empty trailer must not be written")
+	}
+}
+
+func TestMetaAccessors(t *testing.T) {
+
+	req := NewMessage()
+	if req.Method() != "" || req.ID() != "" {
+		t.Fatal("unset method and id must be empty")
+	}
+	req.SetMethod("Author.Login")
+	req.SetID("10-9dad-11d1-80b4-00")
+	req.AddMeta("tag", "a")
+	req.AddMeta("tag", "b")
+	if req.MetaData[Meta_Method] != "Author.Login" || req.MetaData[Meta_ID] != "10-9dad-11d1-80b4-00" {
+		t.Fatal("method and id must be in the reserved meta")
+	}
+
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Method() != "Author.Login" || res.ID() != "10-9dad-11d1-80b4-00" {
+		t.Fatal("method and id round trip error")
+	}
+	tag, ok := res.GetMeta("tag")
+	if !ok || tag != "a" || len(res.GetAll("tag")) != 2 {
+		t.Fatal("get meta must be the first value")
+	}
+	_, ok = res.GetMeta("missing")
+	if ok {
+		t.Fatal("missing meta must not be found")
+	}
+}
+
+func TestEncodeInto(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetChecksum(true)
+	req.MetaData["__METHOD"] = "Author.Login"
+	req.AddMeta("tag", "a")
+	req.AddMeta("tag", "b")
+
+	buf := make([]byte, 0, 1024)
+	for seq := uint64(1); seq <= 3; seq++ {
+		req.Header.SetSeq(seq)
+		req.SetPayload(bytes.Repeat([]byte("k"), int(seq) * 10))
+		data, err := req.EncodeInto(buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if &data[0] != &buf[:1][0] {
+			t.Fatal("large enough buffer must be reused")
+		}
+		encoded, err := req.Encode()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(data, encoded) {
+			t.Fatal("encode into and encode must be the same bytes")
+		}
+		res, err := Decode(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.Header.Seq() != seq || len(res.Payload) != int(seq) * 10 || len(res.GetAll("tag")) != 2 {
+			t.Fatal("decode encoded into message error")
+		}
+	}
+
+	// small buffer is not written
+	small := make([]byte, 4)
+	data, err := req.EncodeInto(small)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if &data[0] == &small[0] || !bytes.Equal(small, make([]byte, 4)) {
+		t.Fatal("small buffer must not be used")
+	}
+}
+
+func BenchmarkEncodeInto(b *testing.B) {
+	msg := NewMessage()
+	msg.Header.SetMessageType(Message_Type_Request)
+	msg.Header.SetChecksum(true)
+	msg.MetaData["__METHOD"] = "Author.Login"
+	msg.SetPayload(bytes.Repeat([]byte("a"), 256))
+	buf := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := msg.EncodeInto(buf)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		buf = data
+	}
+}
+
+func TestPayloadLimit(t *testing.T) {
+
+	key := []byte("kitten secret")
+	large := NewMessage()
+	large.Header.SetChecksum(true)
+	large.SetAuthKey(key)
+	large.MetaData["__METHOD"] = "Author.Upload"
+	large.Trailer = map[string]string{"status": "ok"}
+	large.SetPayload(bytes.Repeat([]byte("k"), 2048))
+	small := NewMessage()
+	small.SetAuthKey(key)
+	small.MetaData["__METHOD"] = "Author.Login"
+	small.SetPayload([]byte("kitten"))
+
+	var buf bytes.Buffer
+	err := WriteMessages(&buf, []*Message{large, small})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	opts := ReadOptions{
+		AuthKey: key,
+		PayloadLimit: func(meta map[string]string) uint32 {
+			if meta["__METHOD"] == "Author.Upload" {
+				return 1024
+			}
+			return 0
+		},
+	}
+	msg, err := ReadMessageOptions(&buf, opts)
+	if err != ErrPayloadTooLarge {
+		t.Fatal("payload over the limit must return ErrPayloadTooLarge")
+	}
+	if msg.MetaData["__METHOD"] != "Author.Upload" || msg.Trailer["status"] != "ok" || cap(msg.Payload) >= 2048 {
+		t.Fatal("payload over the limit must be discarded with the meta data kept")
+	}
+	msg, err = ReadMessageOptions(&buf, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(msg.Payload) != "kitten" {
+		t.Fatal("message after the discarded payload error")
+	}
+
+	// the discarded message is still verified
+	data, err := large.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data[len(data) - 1] ^= 0xff
+	_, err = ReadMessageOptions(bytes.NewReader(data), opts)
+	if err != ErrChecksumMismatch {
+		t.Fatal("corrupted discarded message must return ErrChecksumMismatch")
+	}
+	opts.AuthKey = []byte("other secret")
+	_, err = ReadMessageOptions(bytes.NewReader(data), opts)
+	if err != ErrAuthFailed {
+		t.Fatal("discarded message of another key must return ErrAuthFailed")
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetSeq(0x0102)
+	req.Header.SetChecksum(true)
+	req.SetAuthKey([]byte("kitten secret"))
+	req.MetaData["__METHOD"] = "Author.Login"
+	req.Trailer = map[string]string{"status": "ok"}
+	req.SetPayload([]byte("kitten"))
+
+	// big endian is the default
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if binary.BigEndian.Uint64(data[4:]) != 0x0102 || binary.BigEndian.Uint32(data[Header_Len:]) != uint32(len(encodeMeta(binary.BigEndian, req.MetaData, nil))) {
+		t.Fatal("default byte order must be big endian")
+	}
+
+	req.SetByteOrder(binary.LittleEndian)
+	data, err = req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if binary.LittleEndian.Uint64(data[4:]) != 0x0102 || binary.LittleEndian.Uint32(data[Header_Len:]) != uint32(len(encodeMeta(binary.LittleEndian, req.MetaData, nil))) {
+		t.Fatal("seq and lengths must be little endian")
+	}
+	if req.Header.Seq() != 0x0102 {
+		t.Fatal("header in memory must not change")
+	}
+	var buf bytes.Buffer
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("write to and encode must be the same bytes")
+	}
+
+	decoded, err := DecodeOrder(data, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadMessageOptions(&buf, ReadOptions{AuthKey: []byte("kitten secret"), ByteOrder: binary.LittleEndian})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, m := range []*Message{decoded, res} {
+		if m.Header.Seq() != 0x0102 || m.MetaData["__METHOD"] != "Author.Login" || string(m.Payload) != "kitten" || m.Trailer["status"] != "ok" {
+			t.Fatal("little endian round trip error")
+		}
+	}
+
+	// a little endian frame is not read as big endian
+	_, err = Decode(data)
+	if err == nil {
+		t.Fatal("little endian frame must not decode as big endian")
+	}
+}
+
+func TestMalformedMeta(t *testing.T) {
+
+	meta := encodeMeta(binary.BigEndian, map[string]string{"key": "value", "empty": ""}, nil)
+	decoded := make(map[string]string)
+	_, err := decodeMeta(binary.BigEndian, meta, decoded, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(decoded) != 2 || decoded["key"] != "value" || decoded["empty"] != "" {
+		t.Fatal("decode meta error")
+	}
+
+	// every truncation of the blob is malformed: a short length prefix,
+	// a field shorter than its length, or a key without value
+	for n := 1; n < len(meta); n++ {
+		_, err = decodeMeta(binary.BigEndian, meta[:n], make(map[string]string), 0)
+		if n == 4 + len("empty") + 4 {
+			// the first pair is complete
+			if err != nil {
+				t.Fatalf("truncated meta at the pair end %d error", n)
+			}
+			continue
+		}
+		if err != ErrMalformedMeta {
+			t.Fatalf("truncated meta at %d must return ErrMalformedMeta", n)
+		}
+	}
+
+	// the frame meta length covers the truncated meta
+	req := NewMessage()
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	frame := append([]byte{}, data[:Header_Len]...)
+	frame = append(frame, 0, 0, 0, 5)
+	frame = append(frame, meta[:5]...)
+	frame = append(frame, data[Header_Len+4:]...)
+	_, err = Decode(frame)
+	if err != ErrMalformedMeta {
+		t.Fatal("truncated frame meta must return ErrMalformedMeta")
+	}
+}
+
+func TestMultiMeta(t *testing.T) {
+
+	req := NewMessage()
+	req.AddMeta("Set-Cookie", "a=1")
+	req.AddMeta("Set-Cookie", "b=2")
+	req.AddMeta("__METHOD", "Author.Login")
+	if req.MetaData["Set-Cookie"] != "a=1" {
+		t.Fatal("first value must be in meta data")
+	}
+
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, read := range []func() (*Message, error){
+		func() (*Message, error) { return Decode(data) },
+		func() (*Message, error) { return ReadMessage(bytes.NewReader(data)) },
+	} {
+		res, err := read()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		values := res.GetAll("Set-Cookie")
+		if len(values) != 2 || values[0] != "a=1" || values[1] != "b=2" {
+			t.Fatal("repeated meta values error")
+		}
+		if res.MetaData["Set-Cookie"] != "a=1" || res.MetaData["__METHOD"] != "Author.Login" {
+			t.Fatal("meta data error")
+		}
+		if len(res.GetAll("__METHOD")) != 1 || res.GetAll("unknown") != nil {
+			t.Fatal("single meta values error")
+		}
+	}
+
+	req.SetMetaData(map[string]string{"Set-Cookie": "c=3"})
+	if len(req.GetAll("Set-Cookie")) != 1 {
+		t.Fatal("set meta data must remove repeated values")
+	}
+}
+
+func TestMaxMetaEntries(t *testing.T) {
+
+	msg := NewMessage()
+	for i := 0; i <= Default_Max_Meta_Entries; i++ {
+		msg.AddMeta("k", "")
+	}
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = Decode(data)
+	if err != ErrTooManyMetaEntries {
+		t.Fatal("meta over the default entries must return ErrTooManyMetaEntries")
+	}
+	_, err = ReadMessage(bytes.NewReader(data))
+	if err != ErrTooManyMetaEntries {
+		t.Fatal("meta over the default entries must return ErrTooManyMetaEntries")
+	}
+
+	res, err := ReadMessageOptions(bytes.NewReader(data), ReadOptions{MaxMetaEntries: Default_Max_Meta_Entries + 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res.GetAll("k")) != Default_Max_Meta_Entries + 1 {
+		t.Fatal("meta within max entries error")
+	}
+	_, err = ReadMessageOptions(bytes.NewReader(data), ReadOptions{MaxMetaEntries: 10})
+	if err != ErrTooManyMetaEntries {
+		t.Fatal("meta over max entries must return ErrTooManyMetaEntries")
+	}
+}
+
+func TestMetaOrder(t *testing.T) {
+
+	meta := make(map[string]string)
+	for i := 0; i < 32; i++ {
+		meta[string(rune('a'+i))] = string(rune('A'+i))
+	}
+
+	first := encodeMeta(binary.BigEndian, meta, nil)
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(encodeMeta(binary.BigEndian, meta, nil), first) {
+			t.Fatal("meta encode must be deterministic")
+		}
+	}
+
+	// sign the encoded meta and verify after the round trip
+	key := []byte("kitten secret")
+	mac := hmac.New(sha256.New, key)
+	mac.Write(first)
+	signature := mac.Sum(nil)
+
+	req := NewMessage()
+	req.SetMetaData(meta)
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mac = hmac.New(sha256.New, key)
+	mac.Write(encodeMeta(binary.BigEndian, res.MetaData, nil))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		t.Fatal("meta signature must survive the round trip")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetChecksum(true)
+	req.Header.SetSeq(1)
+	req.SetMetaData(map[string]string{"__METHOD": "Author.Login"})
+	req.SetPayload([]byte("kitten payload"))
+
+	if !req.Header.HasChecksum() {
+		t.Fatal("has checksum false")
+	}
+
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(res.Payload) != "kitten payload" {
+		t.Fatal("payload data error")
+	}
+
+	_, err = Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// flip a payload byte
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-5] ^= 0xff
+
+	_, err = ReadMessage(bytes.NewReader(corrupt))
+	if err != ErrChecksumMismatch {
+		t.Fatal("corrupt payload must return ErrChecksumMismatch")
+	}
+
+	_, err = Decode(corrupt)
+	if err != ErrChecksumMismatch {
+		t.Fatal("corrupt payload must return ErrChecksumMismatch")
+	}
+}
+
+func TestReadMessageMaxBlockLen(t *testing.T) {
+
+	// the max int of a 32-bit platform
+	defer func(max uint64) { maxBlockLen = max }(maxBlockLen)
+	maxBlockLen = 1 << 31 - 1
+
+	// payload length prefix near 4GB without a configured limit
+	var buf bytes.Buffer
+	buf.Write(NewMessage().Header[:])
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00})
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xf0})
+	_, err := ReadMessage(bytes.NewReader(buf.Bytes()))
+	if err != ErrMessageTooLarge {
+		t.Fatal("payload length over the platform max must return ErrMessageTooLarge")
+	}
+
+	// a length within the platform max is read
+	req := NewMessage()
+	req.SetPayload([]byte("kitten"))
+	buf.Reset()
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadMessage(&buf)
+	if err != nil || string(res.Payload) != "kitten" {
+		t.Fatal("payload within the platform max must be read")
+	}
+}
+
+func TestReadMessageLimited(t *testing.T) {
+
+	header := NewMessage().Header
+
+	// meta length prefix 4GB
+	var buf bytes.Buffer
+	buf.Write(header[:])
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	data := buf.Bytes()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := ReadMessageLimited(bytes.NewReader(data), 1024, 1024)
+	runtime.ReadMemStats(&after)
+	if err != ErrMessageTooLarge {
+		t.Fatal("oversized meta must return ErrMessageTooLarge")
+	}
+	if after.TotalAlloc - before.TotalAlloc > 1 << 20 {
+		t.Fatal("oversized meta is allocated")
+	}
+
+	// payload length prefix 4GB
+	buf.Reset()
+	buf.Write(header[:])
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00})
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	data = buf.Bytes()
+
+	runtime.ReadMemStats(&before)
+	_, err = ReadMessageLimited(bytes.NewReader(data), 1024, 1024)
+	runtime.ReadMemStats(&after)
+	if err != ErrMessageTooLarge {
+		t.Fatal("oversized payload must return ErrMessageTooLarge")
+	}
+	if after.TotalAlloc - before.TotalAlloc > 1 << 20 {
+		t.Fatal("oversized payload is allocated")
+	}
+
+	// within limit
+	req := NewMessage()
+	req.SetPayload([]byte("kitten"))
+	buf.Reset()
+	_, err = req.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := ReadMessageLimited(&buf, 1024, 1024)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(res.Payload) != "kitten" {
+		t.Fatal("payload data error")
+	}
+}
+
+func TestReadMessageLimitedCompressed(t *testing.T) {
+
+	// 4MB of zeros compresses far below the limit
+	payload := make([]byte, 4 << 20)
+	for _, compressType := range []byte{Compress_Type_Gzip, Compress_Type_Snappy, Compress_Type_LZ4} {
+		req := NewMessage()
+		req.Header.SetCompressType(compressType)
+		req.SetPayload(payload)
+		var buf bytes.Buffer
+		_, err := req.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if buf.Len() > 1 << 20 {
+			t.Fatal("payload is not compressed")
+		}
+		data := buf.Bytes()
+
+		_, err = ReadMessageLimited(bytes.NewReader(data), 1024, 1 << 20)
+		if err != ErrMessageTooLarge {
+			t.Fatalf("oversized uncompressed payload of compress type %d must return ErrMessageTooLarge", compressType)
+		}
+
+		res, err := ReadMessageLimited(bytes.NewReader(data), 1024, 4 << 20)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(res.Payload) != len(payload) {
+			t.Fatal("payload data error")
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+
+	msg := NewMessage()
+	msg.Header.SetMessageType(Message_Type_Response)
+	msg.Header.SetCompressType(Compress_Type_Gzip)
+	msg.Header.SetSeq(100)
+	msg.MetaData["__METHOD"] = "Author.Login"
+	msg.SetPayload([]byte("kitten"))
+	meta := msg.MetaData
+
+	msg.Reset()
+	if !msg.Header.CheckMagicNumber() {
+		t.Fatal("reset must keep magic number")
+	}
+	if *msg.Header != *NewMessage().Header {
+		t.Fatal("reset header must be zeroed")
+	}
+	if len(msg.MetaData) != 0 {
+		t.Fatal("reset meta data must be cleared")
+	}
+	meta["k"] = "v"
+	if msg.MetaData["k"] != "v" {
+		t.Fatal("reset must not reallocate meta data")
+	}
+	if len(msg.Payload) != 0 || cap(msg.Payload) < len("kitten") {
+		t.Fatal("reset payload must be truncated")
+	}
+
+	pooled := GetMessage()
+	pooled.SetPayload([]byte("kitten"))
+	PutMessage(pooled)
+	pooled = GetMessage()
+	if len(pooled.Payload) != 0 || len(pooled.MetaData) != 0 || pooled.Header.Seq() != 0 {
+		t.Fatal("pooled message must be reset")
+	}
+}
+
+func TestClone(t *testing.T) {
+
+	msg := NewMessage()
+	msg.Header.SetMessageType(Message_Type_Request)
+	msg.Header.SetSeq(100)
+	msg.MetaData["__METHOD"] = "Author.Login"
+	msg.AddMeta("tag", "a")
+	msg.AddMeta("tag", "b")
+	msg.SetPayload([]byte("kitten"))
+
+	clone := msg.Clone()
+	if *clone.Header != *msg.Header || string(clone.Payload) != "kitten" || clone.MetaData["__METHOD"] != "Author.Login" {
+		t.Fatal("clone must equal the message")
+	}
+	if len(clone.GetAll("tag")) != 2 {
+		t.Fatal("clone must copy repeated meta")
+	}
+
+	clone.Header.SetSeq(200)
+	clone.MetaData["__METHOD"] = "Author.Logout"
+	clone.AddMeta("tag", "c")
+	clone.Payload[0] = 'K'
+	if msg.Header.Seq() != 100 || msg.MetaData["__METHOD"] != "Author.Login" || string(msg.Payload) != "kitten" {
+		t.Fatal("modify clone must not change the message")
+	}
+	if len(msg.GetAll("tag")) != 2 {
+		t.Fatal("modify clone repeated meta must not change the message")
+	}
+}
+
+func TestNewMessageHeader(t *testing.T) {
+
+	template := Header{}
+	template[0] = MagicNumber
+	template.SetMessageType(Message_Type_Request)
+	template.SetSerializeType(Serialize_Json)
+
+	first := NewMessageHeader(template)
+	second := NewMessageHeader(template)
+	first.Header.SetSeq(1)
+	if second.Header.Seq() != 0 || template.Seq() != 0 {
+		t.Fatal("messages of the same template must not share the header")
+	}
+	if second.Header.MessageType() != Message_Type_Request || second.Header.SerializeType() != Serialize_Json || !second.Header.CheckMagicNumber() {
+		t.Fatal("message header must be the template")
+	}
+
+	clone := first.Header.Clone()
+	clone.SetSeq(2)
+	if first.Header.Seq() != 1 {
+		t.Fatal("modify header clone must not change the header")
+	}
+}
+
+func TestReadMessageInto(t *testing.T) {
+
+	var buf bytes.Buffer
+	for i, payload := range []string{"first payload", "2nd", ""} {
+		msg := NewMessage()
+		msg.Header.SetSeq(uint64(i + 1))
+		msg.MetaData["index"] = payload
+		if i == 0 {
+			msg.MetaData["first"] = "1"
+		}
+		msg.SetPayload([]byte(payload))
+		_, err := msg.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	msg := NewMessage()
+	err := ReadMessageInto(&buf, msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Header.Seq() != 1 || string(msg.Payload) != "first payload" || msg.MetaData["first"] != "1" {
+		t.Fatal("read message into error")
+	}
+	payload := msg.Payload
+
+	err = ReadMessageInto(&buf, msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Header.Seq() != 2 || string(msg.Payload) != "2nd" || len(msg.MetaData) != 1 {
+		t.Fatal("read message into must clear the previous message")
+	}
+	if &msg.Payload[0] != &payload[0] {
+		t.Fatal("read message into must reuse the payload buffer")
+	}
+
+	err = ReadMessageInto(&buf, msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Header.Seq() != 3 || len(msg.Payload) != 0 || msg.MetaData["index"] != "" {
+		t.Fatal("read message into error")
+	}
+
+	err = ReadMessageInto(&buf, msg)
+	if err != io.EOF {
+		t.Fatal("read message into closed reader must return io.EOF")
+	}
+}
+
+var messageSink *Message
+
+func BenchmarkNewMessage(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := NewMessage()
+		msg.Header.SetSeq(uint64(i))
+		msg.MetaData["__METHOD"] = "Author.Login"
+		messageSink = msg
+	}
+}
+
+func BenchmarkPoolMessage(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := GetMessage()
+		msg.Header.SetSeq(uint64(i))
+		msg.MetaData["__METHOD"] = "Author.Login"
+		messageSink = msg
+		PutMessage(msg)
+	}
+}
+
+// encoded request frame for the read benchmarks
+func benchmarkFrame(b *testing.B) []byte {
+	msg := NewMessage()
+	msg.Header.SetMessageType(Message_Type_Request)
+	msg.MetaData["__METHOD"] = "Author.Login"
+	msg.SetPayload(bytes.Repeat([]byte("a"), 256))
+	data, err := msg.Encode()
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	return data
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	data := benchmarkFrame(b)
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		msg, err := ReadMessage(r)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		messageSink = msg
+	}
+}
+
+func BenchmarkReadMessageInto(b *testing.B) {
+	data := benchmarkFrame(b)
+	r := bytes.NewReader(data)
+	msg := NewMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		err := ReadMessageInto(r, msg)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func TestDecodeMagic(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetMagicNumber(0x42)
+	req.SetByteOrder(binary.LittleEndian)
+	req.Header.SetSeq(9)
+	req.SetPayload([]byte("kitten"))
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = DecodeOrder(data, binary.LittleEndian)
+	if err != ErrBadMagic {
+		t.Fatal("other magic must return ErrBadMagic")
+	}
+	res, err := DecodeMagic(data, binary.LittleEndian, 0x42)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.Seq() != 9 || string(res.Payload) != "kitten" {
+		t.Fatal("decode with the magic error")
+	}
+
+	// the magic of the message header is used
+	res = NewMessage()
+	res.Header.SetMagicNumber(0x42)
+	res.SetByteOrder(binary.LittleEndian)
+	if res.UnmarshalBinary(data) != nil || string(res.Payload) != "kitten" {
+		t.Fatal("unmarshal with the magic of the header error")
+	}
+
+	opts := ReadOptions{ByteOrder: binary.LittleEndian, MagicNumber: 0x42}
+	sizes, err := PeekSizesOptions(bufio.NewReader(bytes.NewReader(data)), opts)
+	if err != nil || sizes.Frame != uint64(len(data)) {
+		t.Fatal("peek sizes with the magic error")
+	}
+	_, err = PeekSizes(bufio.NewReader(bytes.NewReader(data)))
+	if err != ErrBadMagic {
+		t.Fatal("peek sizes of other magic must return ErrBadMagic")
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetMessageType(Message_Type_Request)
+	req.Header.SetSeq(9)
+	req.Header.SetChecksum(true)
+	req.SetMethod("Author.Login")
+	req.AddMeta("tag", "a")
+	req.AddMeta("tag", "b")
+	req.SetPayload([]byte("kitten"))
+	req.Trailer = map[string]string{"status": "done"}
+
+	var marshaler encoding.BinaryMarshaler = req
+	data, err := marshaler.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res := &Message{}
+	var unmarshaler encoding.BinaryUnmarshaler = res
+	err = unmarshaler.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.Seq() != 9 || res.Method() != "Author.Login" || len(res.GetAll("tag")) != 2 ||
+		string(res.Payload) != "kitten" || res.Trailer["status"] != "done" {
+		t.Fatal("unmarshal marshaled message error")
+	}
+
+	// the byte order of the message is used
+	req.SetByteOrder(binary.LittleEndian)
+	data, err = req.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res = NewMessage()
+	res.SetByteOrder(binary.LittleEndian)
+	if res.UnmarshalBinary(data) != nil || res.Header.Seq() != 9 {
+		t.Fatal("unmarshal little endian message error")
+	}
+
+	// trailing and missing bytes
+	if res.UnmarshalBinary(append(data, 0)) != ErrInvalidLength {
+		t.Fatal("trailing bytes must be an invalid length")
+	}
+	if res.UnmarshalBinary(data[:len(data) - 1]) != ErrInvalidLength {
+		t.Fatal("truncated data must be an invalid length")
+	}
+
+	bad := append([]byte{}, data...)
+	bad[0] = 0x01
+	if res.UnmarshalBinary(bad) != ErrBadMagic {
+		t.Fatal("invalid magic number must be rejected")
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+
+	header := NewMessage().Header
+	header.SetVersion(Max_Version)
+	header.SetMessageType(Message_Type_Response)
+	header.SetHeartBeat(true)
+	header.SetOneWay(true)
+	header.SetCompressType(Compress_Type_Gzip)
+	header.SetMessageStatusType(Message_Status_Exception)
+	header.SetSerializeType(Serialize_Json)
+	header.SetChecksum(true)
+	header.SetAuth(true)
+	header.SetTrailer(true)
+	header.SetSeq(42)
+
+	fields := DecodeHeader(*header)
+	expect := HeaderFields{
+		MagicNumber: header.MagicNumber(),
+		Version: header.Version(),
+		MessageType: header.MessageType(),
+		HeartBeat: header.IsHeartBeat(),
+		OneWay: header.IsOneWay(),
+		CompressType: header.CompressType(),
+		MessageStatusType: header.MessageStatusType(),
+		SerializeType: header.SerializeType(),
+		Checksum: header.HasChecksum(),
+		Auth: header.HasAuth(),
+		Trailer: header.HasTrailer(),
+		Segment: header.IsSegment(),
+		Seq: header.Seq(),
+	}
+	if fields != expect {
+		t.Fatal("decoded header must match the getters")
+	}
+	if fields.CompressType != Compress_Type_Gzip || !fields.Trailer || fields.Seq != 42 {
+		t.Fatal("decoded header fields error")
+	}
+
+	// the masks cover the bits of the getters
+	if (header[2] & Header_Compress_Type_Mask) >> Header_Compress_Type_Shift != Compress_Type_Gzip ||
+		(header[3] & Header_Serialize_Type_Mask) >> Header_Serialize_Type_Shift != Serialize_Json {
+		t.Fatal("header masks error")
+	}
+}
+
+// message of n meta entries with long values
+func largeMetaMessage(n int) *Message {
+	msg := NewMessage()
+	msg.Header.SetChecksum(true)
+	msg.SetAuthKey([]byte("secret"))
+	for i := 0; i < n; i++ {
+		msg.MetaData["key-" + strconv.Itoa(i)] = string(bytes.Repeat([]byte("v"), 64))
+	}
+	msg.AddMeta("key-0", string(bytes.Repeat([]byte("x"), 2 * Meta_Chunk_Len)))
+	msg.SetPayload([]byte("kitten"))
+	return msg
+}
+
+func TestWriteToLargeMeta(t *testing.T) {
+
+	msg := largeMetaMessage(1000)
+	var buf bytes.Buffer
+	_, err := msg.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("chunked meta must be written like the encoded meta")
+	}
+	res, err := ReadMessageOptions(&buf, ReadOptions{AuthKey: []byte("secret"), MaxMetaEntries: 2000})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res.MetaData) != 1000 || len(res.GetAll("key-0")) != 2 {
+		t.Fatal("large meta error")
+	}
+}
+
+// the meta encoded whole before it is written
+func BenchmarkEncodeMetaLarge(b *testing.B) {
+	msg := largeMetaMessage(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		meta := encodeMeta(binary.BigEndian, msg.MetaData, msg.extraMeta)
+		writeBlock(ioutil.Discard, binary.BigEndian, meta)
+	}
+}
+
+// the meta written in chunks
+func BenchmarkWriteMetaLarge(b *testing.B) {
+	msg := largeMetaMessage(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeMeta(ioutil.Discard, ioutil.Discard, binary.BigEndian, msg.MetaData, msg.extraMeta)
+	}
+}
+
+func TestSize(t *testing.T) {
+
+	empty := NewMessage()
+	meta := NewMessage()
+	meta.SetMethod("Author.Login")
+	meta.AddMeta("tag", "a")
+	meta.AddMeta("tag", "b")
+	meta.SetPayload([]byte("kitten"))
+	full := meta.Clone()
+	full.Header.SetChecksum(true)
+	full.SetAuthKey([]byte("secret"))
+	full.Trailer = map[string]string{"status": "done"}
+	compressed := NewMessage()
+	compressed.Header.SetCompressType(Compress_Type_Gzip)
+	compressed.SetPayload(bytes.Repeat([]byte("kitten"), Default_Compress_Threshold))
+	short := NewMessage()
+	short.Header.SetCompressType(Compress_Type_Gzip)
+	short.SetPayload([]byte("kitten"))
+
+	for i, msg := range []*Message{empty, meta, full, compressed, short} {
+		data, err := msg.Encode()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if msg.Size() != len(data) {
+			t.Fatalf("size of message %d must be the encoded length", i)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+)
+
+const (
+	// max message length of a single udp datagram over ipv4, a longer message can't be sent as a packet
+	Max_Packet_Len int = 65507
+)
+
+// ReadMessageFromPacket read the single message of a datagram like ReadMessage,
+// the datagram must hold exactly one whole message or ErrInvalidLength is returned
+func ReadMessageFromPacket(data []byte) (*Message, error) {
+	return ReadPacketOptions(data, ReadOptions{})
+}
+
+// ReadPacketOptions read the single message of a datagram like ReadMessageFromPacket with the options
+func ReadPacketOptions(data []byte, opts ReadOptions) (*Message, error) {
+	if len(data) > Max_Packet_Len {
+		return nil, ErrMessageTooLarge
+	}
+	r := bytes.NewReader(data)
+	msg, err := ReadMessageOptions(r, opts)
+	if err != nil {
+		return nil, unexpectedLength(err)
+	}
+	if r.Len() > 0 {
+		return nil, ErrInvalidLength
+	}
+	return msg, nil
+}
+
+// a truncated datagram is an invalid length like a truncated Decode
+func unexpectedLength(err error) error {
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return ErrInvalidLength
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestReadMessageFromPacket(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetOneWay(true)
+	req.Header.SetChecksum(true)
+	req.SetMethod("Log.Write")
+	req.SetPayload([]byte("kitten"))
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	msg, err := ReadMessageFromPacket(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !msg.Header.IsOneWay() || msg.Method() != "Log.Write" || string(msg.Payload) != "kitten" {
+		t.Fatal("packet message error")
+	}
+
+	_, err = ReadMessageFromPacket(data[:len(data) - 1])
+	if err != ErrInvalidLength {
+		t.Fatal("truncated packet must return ErrInvalidLength")
+	}
+	_, err = ReadMessageFromPacket(append(data, data...))
+	if err != ErrInvalidLength {
+		t.Fatal("packet of two messages must return ErrInvalidLength")
+	}
+	_, err = ReadMessageFromPacket(make([]byte, Max_Packet_Len + 1))
+	if err != ErrMessageTooLarge {
+		t.Fatal("packet over Max_Packet_Len must return ErrMessageTooLarge")
+	}
+}
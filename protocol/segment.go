@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"io"
+	"strconv"
+)
+
+// SplitSegments split the payload of the message into segments of segmentLen bytes at most, for a payload
+// over the uint32 payload length. the segments share the seq and the payload of the message, they carry
+// the segment flag and the segment index and total in the meta. the first segment carries the meta data
+// and the last one the trailer. a payload within segmentLen is not segmented and the message is returned.
+// the segments must be written back to back, ReassemblingReader reads them as one payload
+func SplitSegments(message *Message, segmentLen int) []*Message {
+	if segmentLen <= 0 || len(message.Payload) <= segmentLen {
+		return []*Message{message}
+	}
+	total := (len(message.Payload) + segmentLen - 1) / segmentLen
+	segments := make([]*Message, total)
+	for i := range segments {
+		segment := NewMessageHeader(*message.Header)
+		segment.compressThreshold = message.compressThreshold
+		segment.authKey = message.authKey
+		segment.byteOrder = message.byteOrder
+		if i == 0 {
+			for k, v := range message.MetaData {
+				segment.MetaData[k] = v
+			}
+			segment.extraMeta = message.extraMeta
+		}
+		if i == total - 1 {
+			segment.Trailer = message.Trailer
+		}
+		segment.Header.SetSegment(true)
+		segment.MetaData[Meta_Segment] = strconv.Itoa(i)
+		segment.MetaData[Meta_Segments] = strconv.Itoa(total)
+		end := (i + 1) * segmentLen
+		if end > len(message.Payload) {
+			end = len(message.Payload)
+		}
+		segment.Payload = message.Payload[i * segmentLen:end]
+		segments[i] = segment
+	}
+	return segments
+}
+
+// ReassemblingReader read the payloads of the segments sharing the seq of the first segment as one payload,
+// the following segments are read off the reader as the payload is read
+type ReassemblingReader struct {
+	r io.Reader
+	opts ReadOptions
+	seq uint64
+	// index of the next segment and the total segments
+	next int
+	total int
+	// unread payload of the current segment
+	payload []byte
+	// trailer of the last segment
+	trailer map[string]string
+	err error
+}
+
+// NewReassemblingReader returns a reader of the whole payload of the first segment read off r,
+// the following segments are read off r with the options. a message without the segment flag
+// is read as its own payload
+func NewReassemblingReader(r io.Reader, first *Message, opts ReadOptions) (*ReassemblingReader, error) {
+	rr := &ReassemblingReader{r: r, opts: opts, seq: first.Header.Seq(), payload: first.Payload, next: 1, total: 1}
+	if !first.Header.IsSegment() {
+		rr.trailer = first.Trailer
+		return rr, nil
+	}
+	index, total, err := segmentIndex(first)
+	if err != nil {
+		return nil, err
+	}
+	if index != 0 {
+		return nil, ErrInvalidSegment
+	}
+	rr.total = total
+	if total == 1 {
+		rr.trailer = first.Trailer
+	}
+	return rr, nil
+}
+
+// Read the payload of the segments, io.EOF after the last segment.
+// ErrInvalidSegment is returned for a missing or out of order segment
+func (rr *ReassemblingReader) Read(p []byte) (int, error) {
+	for len(rr.payload) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		if rr.next == rr.total {
+			rr.err = io.EOF
+			return 0, io.EOF
+		}
+		rr.err = rr.readSegment()
+	}
+	n := copy(p, rr.payload)
+	rr.payload = rr.payload[n:]
+	return n, nil
+}
+
+// Trailer of the last segment, nil before the last segment is read
+func (rr *ReassemblingReader) Trailer() map[string]string {
+	return rr.trailer
+}
+
+// read the next segment of the seq
+func (rr *ReassemblingReader) readSegment() error {
+	segment, err := ReadMessageOptions(rr.r, rr.opts)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if !segment.Header.IsSegment() || segment.Header.Seq() != rr.seq {
+		return ErrInvalidSegment
+	}
+	index, total, err := segmentIndex(segment)
+	if err != nil {
+		return err
+	}
+	if index != rr.next || total != rr.total {
+		return ErrInvalidSegment
+	}
+	rr.next++
+	rr.payload = segment.Payload
+	if rr.next == rr.total {
+		rr.trailer = segment.Trailer
+	}
+	return nil
+}
+
+// index and total of the segment meta
+func segmentIndex(segment *Message) (int, int, error) {
+	index, err := strconv.Atoi(segment.MetaData[Meta_Segment])
+	if err != nil {
+		return 0, 0, ErrInvalidSegment
+	}
+	total, err := strconv.Atoi(segment.MetaData[Meta_Segments])
+	if err != nil || index < 0 || total <= index {
+		return 0, 0, ErrInvalidSegment
+	}
+	return index, total, nil
+}
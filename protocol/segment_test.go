@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"testing"
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+func TestSegments(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetSeq(7)
+	req.Header.SetChecksum(true)
+	req.SetMethod("File.Upload")
+	req.SetPayload(bytes.Repeat([]byte("kitten"), 50))
+	req.Trailer = map[string]string{"sha": "abc"}
+
+	segments := SplitSegments(req, 100)
+	if len(segments) != 3 {
+		t.Fatal("payload must be split into 3 segments")
+	}
+	var buf bytes.Buffer
+	for _, segment := range segments {
+		_, err := segment.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	first, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !first.Header.IsSegment() || first.Method() != "File.Upload" {
+		t.Fatal("first segment must carry the meta data")
+	}
+	rr, err := NewReassemblingReader(&buf, first, ReadOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	payload, err := ioutil.ReadAll(rr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(payload, req.Payload) {
+		t.Fatal("reassembled payload error")
+	}
+	if rr.Trailer()["sha"] != "abc" {
+		t.Fatal("trailer of the last segment error")
+	}
+
+	// a payload within the segment length is not segmented
+	if len(SplitSegments(req, len(req.Payload))) != 1 {
+		t.Fatal("short payload must not be segmented")
+	}
+}
+
+func TestSegmentsOutOfOrder(t *testing.T) {
+
+	req := NewMessage()
+	req.Header.SetSeq(7)
+	req.SetPayload(bytes.Repeat([]byte("k"), 300))
+	segments := SplitSegments(req, 100)
+
+	var buf bytes.Buffer
+	for _, i := range []int{0, 2, 1} {
+		segments[i].WriteTo(&buf)
+	}
+	first, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rr, err := NewReassemblingReader(&buf, first, ReadOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = ioutil.ReadAll(rr)
+	if err != ErrInvalidSegment {
+		t.Fatal("out of order segment must be invalid")
+	}
+
+	// a missing segment
+	buf.Reset()
+	segments[0].WriteTo(&buf)
+	first, _ = ReadMessage(&buf)
+	rr, _ = NewReassemblingReader(&buf, first, ReadOptions{})
+	_, err = ioutil.ReadAll(rr)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("missing segment must be unexpected EOF")
+	}
+}
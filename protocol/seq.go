@@ -0,0 +1,21 @@
+package protocol
+
+import (
+	"sync/atomic"
+)
+
+// SeqGenerator allocate unique sequence numbers, safe for concurrent use.
+// the zero value is ready to use, 0 is never returned so it can be used as a sentinel
+type SeqGenerator struct {
+	seq uint64
+}
+
+// Next sequence number, wraps around after math.MaxUint64 and skips 0
+func (g *SeqGenerator) Next() uint64 {
+	for {
+		seq := atomic.AddUint64(&g.seq, 1)
+		if seq != 0 {
+			return seq
+		}
+	}
+}
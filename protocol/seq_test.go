@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"testing"
+	"sync"
+	"math"
+)
+
+func TestSeqGenerator(t *testing.T) {
+
+	g := &SeqGenerator{}
+
+	var lock sync.Mutex
+	seqs := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				seq := g.Next()
+				lock.Lock()
+				if seqs[seq] {
+					t.Error("seq is not unique")
+				}
+				seqs[seq] = true
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seqs) != 100 * 1000 {
+		t.Fatal("seq count error")
+	}
+	if seqs[0] {
+		t.Fatal("seq must not be 0")
+	}
+}
+
+func TestSeqGeneratorWrap(t *testing.T) {
+
+	g := &SeqGenerator{seq: math.MaxUint64 - 1}
+	if g.Next() != math.MaxUint64 {
+		t.Fatal("seq error")
+	}
+	if g.Next() != 1 {
+		t.Fatal("seq must skip 0 on wrap")
+	}
+}
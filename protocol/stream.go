@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// WriteStream write the message with the payload copied from the reader instead of message.Payload,
+// length is the exact payload length. the streamed payload is written uncompressed,
+// the hmac and checksum are computed while copying, the trailer is written after the payload
+func (message *Message) WriteStream(w io.Writer, payload io.Reader, length uint32) error {
+	header := *message.Header
+	header.SetCompressType(Compress_Type_None)
+	header.SetAuth(message.authKey != nil)
+	trailer := message.encodeTrailer(&header)
+	order := message.order()
+	wireSeq(&header, order)
+	_, err := w.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	meta := encodeMeta(order, message.MetaData, message.extraMeta)
+	err = writeBlock(w, order, meta)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w, order, length)
+	if err != nil {
+		return err
+	}
+	var mac hash.Hash
+	if header.HasAuth() {
+		mac = hmac.New(sha256.New, message.authKey)
+		mac.Write(header[:])
+		mac.Write(meta)
+		payload = io.TeeReader(payload, mac)
+	}
+	var h hash.Hash32
+	if header.HasChecksum() {
+		h = crc32.NewIEEE()
+		h.Write(meta)
+		payload = io.TeeReader(payload, h)
+	}
+	_, err = io.CopyN(w, payload, int64(length))
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	if header.HasTrailer() {
+		err = writeBlock(w, order, trailer)
+		if err != nil {
+			return err
+		}
+		if mac != nil {
+			mac.Write(trailer)
+		}
+		if h != nil {
+			h.Write(trailer)
+		}
+	}
+
+	if mac != nil {
+		_, err = w.Write(mac.Sum(nil))
+		if err != nil {
+			return err
+		}
+	}
+	if h != nil {
+		err = binary.Write(w, order, h.Sum32())
+	}
+	return err
+}
+
+// ReadStream read the header and meta data of a framed message, the payload is returned
+// as a reader bounded to the payload length, message.Payload is empty.
+// the payload reader must be read to io.EOF before reading the next message from r,
+// the checksum is verified at the end and ErrChecksumMismatch is returned instead of io.EOF,
+// the hmac is not verified. message.Trailer is read at the end of the payload.
+// the message is read in binary.BigEndian.
+// a compressed payload is uncompressed in memory
+func ReadStream(r io.Reader) (*Message, io.Reader, error) {
+	return ReadStreamOptions(r, ReadOptions{})
+}
+
+// ReadStreamOptions read the message like ReadStream with the byte order, magic number and meta limits
+// of the options, the hmac is not verified and the payload limits don't apply to the payload reader
+func ReadStreamOptions(r io.Reader, opts ReadOptions) (*Message, io.Reader, error) {
+	order := byteOrder(opts.ByteOrder)
+	msg := NewMessage()
+	metaByte, err := readHead(r, msg, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lenData := make([]byte, 4)
+	_, err = io.ReadFull(r, lenData)
+	if err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	payload := &payloadReader{
+		r: &io.LimitedReader{R: r, N: int64(order.Uint32(lenData))},
+		src: r,
+		msg: msg,
+		order: order,
+		opts: opts,
+	}
+	if msg.Header.HasChecksum() {
+		payload.h = crc32.NewIEEE()
+		payload.h.Write(metaByte)
+	}
+
+	if msg.Header.CompressType() == Compress_Type_None {
+		return msg, payload, nil
+	}
+	data, err := ioutil.ReadAll(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = uncompress(msg.Header.CompressType(), data, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, bytes.NewReader(data), nil
+}
+
+// payload reader of the stream, verify the checksum at the end of the payload
+type payloadReader struct {
+	r *io.LimitedReader
+	src io.Reader
+	// message of the stream, the trailer is read into it and the hmac is skipped
+	msg *Message
+	// byte order and meta limits of the trailer and checksum
+	order binary.ByteOrder
+	opts ReadOptions
+	h hash.Hash32
+	// sticky error of the end of the payload
+	err error
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n, err := p.r.Read(b)
+	if p.h != nil {
+		p.h.Write(b[:n])
+	}
+	if err == io.EOF {
+		err = p.finish()
+	}
+	p.err = err
+	return n, err
+}
+
+// end of the limited payload, verify it is complete and the checksum matches
+func (p *payloadReader) finish() error {
+	if p.r.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	trailer, err := readTrailer(p.src, p.order, p.msg, p.opts.MaxMeta, p.opts.MaxMetaEntries)
+	if err != nil {
+		return err
+	}
+	if p.h != nil {
+		p.h.Write(trailer)
+	}
+	if p.msg.Header.HasAuth() {
+		_, err := io.CopyN(ioutil.Discard, p.src, int64(Auth_Len))
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	if p.h == nil {
+		return io.EOF
+	}
+	sum := make([]byte, 4)
+	_, err = io.ReadFull(p.src, sum)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if p.order.Uint32(sum) != p.h.Sum32() {
+		return ErrChecksumMismatch
+	}
+	return io.EOF
+}
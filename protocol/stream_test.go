@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"testing"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"crypto/sha256"
+)
+
+func TestStream(t *testing.T) {
+
+	// 32MB payload streamed through a pipe
+	const length = 32 << 20
+	chunk := bytes.Repeat([]byte("kitten stream "), 1024)
+	payload := func() io.Reader {
+		readers := make([]io.Reader, 0)
+		for n := 0; n < length; n += len(chunk) {
+			readers = append(readers, bytes.NewReader(chunk))
+		}
+		return io.LimitReader(io.MultiReader(readers...), length)
+	}
+	want := sha256.New()
+	io.Copy(want, payload())
+
+	req := NewMessage()
+	req.Header.SetSeq(8)
+	req.Header.SetChecksum(true)
+	req.MetaData["__METHOD"] = "File.Upload"
+	req.Trailer = map[string]string{"sha256": string(want.Sum(nil))}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(req.WriteStream(w, payload(), length))
+	}()
+
+	res, body, err := ReadStream(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.Seq() != 8 || res.MetaData["__METHOD"] != "File.Upload" {
+		t.Fatal("stream header or meta data error")
+	}
+	got := sha256.New()
+	n, err := io.Copy(got, body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != length || !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Fatal("stream payload error")
+	}
+	if res.Trailer["sha256"] != string(want.Sum(nil)) {
+		t.Fatal("stream trailer error")
+	}
+
+	// short payload reader
+	var buf bytes.Buffer
+	err = req.WriteStream(&buf, bytes.NewReader([]byte("kit")), 6)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("short payload must return io.ErrUnexpectedEOF")
+	}
+
+	// stream is a normal frame, corrupt checksum is detected at the end
+	buf.Reset()
+	err = req.WriteStream(&buf, bytes.NewReader([]byte("kitten")), 6)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := buf.Bytes()
+	msg, err := Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(msg.Payload) != "kitten" {
+		t.Fatal("streamed payload decode error")
+	}
+	data[len(data)-1] ^= 0xff
+	_, body, err = ReadStream(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = io.Copy(ioutil.Discard, body)
+	if err != ErrChecksumMismatch {
+		t.Fatal("corrupt stream must return ErrChecksumMismatch")
+	}
+}
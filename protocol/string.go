@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// compile time check the constants fit their header bits
+const (
+	// message type is 1 bit
+	_ byte = 1 - Message_Type_Response
+	// compress type is 3 bits
+	_ byte = 7 - Compress_Type_LZ4
+	// message status type is 2 bits
+	_ byte = 3 - Message_Status_Exception
+	// serialize type is 4 bits
+	_ byte = 15 - Serialize_Gob
+)
+
+// MessageTypeString name of the message type
+func MessageTypeString(messageType byte) string {
+	switch messageType {
+	case Message_Type_Request:
+		return "request"
+	case Message_Type_Response:
+		return "response"
+	}
+	return unknownString(messageType)
+}
+
+// CompressTypeString name of the compress type
+func CompressTypeString(compressType byte) string {
+	switch compressType {
+	case Compress_Type_None:
+		return "none"
+	case Compress_Type_Gzip:
+		return "gzip"
+	case Compress_Type_Snappy:
+		return "snappy"
+	case Compress_Type_LZ4:
+		return "lz4"
+	}
+	return unknownString(compressType)
+}
+
+// MessageStatusTypeString name of the message status type
+func MessageStatusTypeString(statusType byte) string {
+	switch statusType {
+	case Message_Status_Normal:
+		return "normal"
+	case Message_Status_Exception:
+		return "exception"
+	}
+	return unknownString(statusType)
+}
+
+// SerializeTypeString name of the serialize type
+func SerializeTypeString(serializeType byte) string {
+	switch serializeType {
+	case Serialize_None:
+		return "none"
+	case Serialize_Json:
+		return "json"
+	case Serialize_Protobuf:
+		return "protobuf"
+	case Serialize_Msgpack:
+		return "msgpack"
+	case Serialize_Gob:
+		return "gob"
+	}
+	return unknownString(serializeType)
+}
+
+// name of the unknown constant
+func unknownString(v byte) string {
+	return "unknown(" + strconv.Itoa(int(v)) + ")"
+}
+
+// String all decoded fields of the header
+func (header *Header) String() string {
+	return fmt.Sprintf("magic=%#02x version=%d type=%s heartbeat=%t oneway=%t compress=%s status=%s serialize=%s checksum=%t hmac=%t trailer=%t segment=%t seq=%d",
+		header[0], header.Version(), MessageTypeString(header.MessageType()), header.IsHeartBeat(), header.IsOneWay(),
+		CompressTypeString(header.CompressType()), MessageStatusTypeString(header.MessageStatusType()),
+		SerializeTypeString(header.SerializeType()), header.HasChecksum(), header.HasAuth(), header.HasTrailer(), header.IsSegment(), header.Seq())
+}
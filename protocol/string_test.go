@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestHeaderString(t *testing.T) {
+
+	header := NewMessage().Header
+	header.SetVersion(1)
+	header.SetMessageType(Message_Type_Response)
+	header.SetHeartBeat(true)
+	header.SetOneWay(true)
+	header.SetCompressType(Compress_Type_Snappy)
+	header.SetMessageStatusType(Message_Status_Exception)
+	header.SetSerializeType(Serialize_Msgpack)
+	header.SetChecksum(true)
+	header.SetAuth(true)
+	header.SetTrailer(true)
+	header.SetSegment(true)
+	header.SetSeq(12345)
+
+	want := "magic=0x08 version=1 type=response heartbeat=true oneway=true compress=snappy status=exception serialize=msgpack checksum=true hmac=true trailer=true segment=true seq=12345"
+	if header.String() != want {
+		t.Fatal("header string error: " + header.String())
+	}
+
+	if CompressTypeString(6) != "unknown(6)" || SerializeTypeString(Serialize_Json) != "json" {
+		t.Fatal("type string error")
+	}
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"context"
+)
+
+// Trace trace and span ids of a call, carried in the request meta
+type Trace struct {
+	TraceID string
+	SpanID string
+	// span id of the caller, empty for the root span
+	ParentSpanID string
+}
+
+// context key of the trace
+type traceKey struct{}
+
+// WithTrace returns a copy of ctx with the span of the trace, the span of ctx if any is the parent.
+// a client call of the context sends the trace and the server handler context carries it
+func WithTrace(ctx context.Context, traceID string, spanID string) context.Context {
+	trace := Trace{TraceID: traceID, SpanID: spanID}
+	if parent, ok := TraceFromContext(ctx); ok {
+		trace.ParentSpanID = parent.SpanID
+	}
+	return ContextWithTrace(ctx, trace)
+}
+
+// ContextWithTrace returns a copy of ctx with the trace
+func ContextWithTrace(ctx context.Context, trace Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// TraceFromContext returns the trace of ctx, false if none
+func TraceFromContext(ctx context.Context) (Trace, bool) {
+	trace, ok := ctx.Value(traceKey{}).(Trace)
+	return trace, ok
+}
+
+// SetTrace set the trace meta of the message, empty ids are not set
+func (message *Message) SetTrace(trace Trace) {
+	setMeta(message.MetaData, Meta_Trace_ID, trace.TraceID)
+	setMeta(message.MetaData, Meta_Span_ID, trace.SpanID)
+	setMeta(message.MetaData, Meta_Parent_Span, trace.ParentSpanID)
+}
+
+// Trace get the trace of the message meta, false if there is no trace id
+func (message *Message) Trace() (Trace, bool) {
+	traceID, ok := message.GetMeta(Meta_Trace_ID)
+	if !ok {
+		return Trace{}, false
+	}
+	return Trace{
+		TraceID: traceID,
+		SpanID: message.MetaData[Meta_Span_ID],
+		ParentSpanID: message.MetaData[Meta_Parent_Span],
+	}, true
+}
+
+// set the meta value if it is not empty
+func setMeta(meta map[string]string, key string, value string) {
+	if value != "" {
+		meta[key] = value
+	}
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"testing"
+	"context"
+)
+
+func TestTrace(t *testing.T) {
+
+	ctx := WithTrace(context.Background(), "t1", "s1")
+	ctx = WithTrace(ctx, "t1", "s2")
+	trace, ok := TraceFromContext(ctx)
+	if !ok || trace.TraceID != "t1" || trace.SpanID != "s2" || trace.ParentSpanID != "s1" {
+		t.Fatal("span of the context must be the parent")
+	}
+
+	req := NewMessage()
+	req.SetTrace(trace)
+	data, err := req.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := Decode(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decoded, ok := res.Trace()
+	if !ok || decoded != trace {
+		t.Fatal("trace of the meta error")
+	}
+
+	if _, ok := NewMessage().Trace(); ok {
+		t.Fatal("message without trace id must have no trace")
+	}
+	if _, ok := TraceFromContext(context.Background()); ok {
+		t.Fatal("context without trace must have no trace")
+	}
+}
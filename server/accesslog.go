@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+// AccessEntry access log entry of a request, heartbeats and one way requests are flagged
+type AccessEntry struct {
+	// start time of the request
+	Time time.Time
+	// remote address of the connection
+	RemoteAddr string
+	// request method, empty for a heartbeat
+	Method string
+	// request seq
+	Seq uint64
+	// response status, protocol.Message_Status_Normal or protocol.Message_Status_Exception
+	Status byte
+	// payload length of the request and the response, 0 out for one way request
+	PayloadIn int
+	PayloadOut int
+	// duration of handling and writing the request
+	Duration time.Duration
+	// is one way request
+	OneWay bool
+	// is heartbeat or ping request
+	HeartBeat bool
+}
+
+// String access log line of the entry
+func (e *AccessEntry) String() string {
+	status := "ok"
+	if e.Status == protocol.Message_Status_Exception {
+		status = "exception"
+	}
+	flags := "-"
+	if e.HeartBeat && e.OneWay {
+		flags = "heartbeat,oneway"
+	}else if e.HeartBeat {
+		flags = "heartbeat"
+	}else if e.OneWay {
+		flags = "oneway"
+	}
+	return fmt.Sprintf("%s %s %q %d %s %d %d %s %s", e.Time.Format(time.RFC3339Nano), e.RemoteAddr,
+		e.Method, e.Seq, status, e.PayloadIn, e.PayloadOut, e.Duration, flags)
+}
+
+// write the access log entry of the served request
+func (c *connection) accessLog(req *protocol.Message, res *protocol.Message, start time.Time) {
+	if c.server.AccessLog == nil {
+		return
+	}
+	entry := &AccessEntry{
+		Time: start,
+		RemoteAddr: c.remoteAddr.String(),
+		Method: req.Method(),
+		Seq: req.Header.Seq(),
+		PayloadIn: len(req.Payload),
+		Duration: time.Since(start),
+		OneWay: req.Header.IsOneWay(),
+		HeartBeat: req.Header.IsHeartBeat() || req.Method() == protocol.Method_Ping,
+	}
+	if res != nil {
+		entry.Status = res.Header.MessageStatusType()
+		if !entry.OneWay {
+			entry.PayloadOut = len(res.Payload)
+		}
+	}
+	c.server.AccessLog(entry)
+}
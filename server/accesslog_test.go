@@ -0,0 +1,99 @@
+package server
+
+import (
+	"testing"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+// capture the access log entries
+type captureAccessLog struct {
+	mutex sync.Mutex
+	entries []*AccessEntry
+}
+
+func (l *captureAccessLog) log(entry *AccessEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+// wait for n entries
+func (l *captureAccessLog) wait(t *testing.T, n int) []*AccessEntry {
+	for i := 0; i < 100; i++ {
+		l.mutex.Lock()
+		entries := l.entries
+		l.mutex.Unlock()
+		if len(entries) >= n {
+			return entries
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("access log entries missing")
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+
+	server := NewServer()
+	accessLog := &captureAccessLog{}
+	server.AccessLog = accessLog.log
+	server.Handle("Echo.Upper", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload([]byte(strings.ToUpper(string(req.Payload)) + "!"))
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	start := time.Now()
+	call(t, clientConn, 10, "Echo.Upper", []byte("kitten"))
+	entry := accessLog.wait(t, 1)[0]
+	if entry.Method != "Echo.Upper" || entry.Seq != 10 || entry.Status != protocol.Message_Status_Normal {
+		t.Fatal("access log method, seq or status error")
+	}
+	if entry.PayloadIn != 6 || entry.PayloadOut != 7 {
+		t.Fatal("access log payload bytes error")
+	}
+	if entry.RemoteAddr != serverConn.RemoteAddr().String() || entry.Time.Before(start) || entry.Duration <= 0 {
+		t.Fatal("access log remote addr, time or duration error")
+	}
+	if entry.OneWay || entry.HeartBeat {
+		t.Fatal("normal request must not be flagged")
+	}
+	if !strings.Contains(entry.String(), `"Echo.Upper" 10 ok 6 7`) {
+		t.Fatal("access log line error: " + entry.String())
+	}
+
+	// one way and heartbeat requests are flagged
+	oneWay := protocol.NewMessage()
+	oneWay.Header.SetOneWay(true)
+	oneWay.Header.SetSeq(11)
+	oneWay.SetMetaData(map[string]string{protocol.Meta_Method: "Echo.Upper"})
+	_, err := oneWay.WriteTo(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	heartbeat := protocol.NewMessage()
+	heartbeat.Header.SetHeartBeat(true)
+	heartbeat.Header.SetOneWay(true)
+	heartbeat.Header.SetSeq(12)
+	_, err = heartbeat.WriteTo(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	entries := accessLog.wait(t, 3)
+	for _, entry := range entries[1:] {
+		if entry.Seq == 11 && (!entry.OneWay || entry.HeartBeat || entry.PayloadOut != 0) {
+			t.Fatal("one way request must be flagged")
+		}
+		if entry.Seq == 12 && (!entry.OneWay || !entry.HeartBeat || !strings.HasSuffix(entry.String(), "heartbeat,oneway")) {
+			t.Fatal("heartbeat request must be flagged")
+		}
+	}
+}
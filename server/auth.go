@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"github.com/phachon/kitten/protocol"
+)
+
+// context key of the authenticated principal
+type principalKey struct{}
+
+// AuthInterceptor returns an Interceptor requiring a token in the meta key of every request, protocol.Meta_Auth
+// if key is empty. validate returns the principal of the token, available to the handler by PrincipalFromContext.
+// a request with a missing token or a token validate rejects gets a protocol.Err_Code_Unauthenticated
+// exception and the handler is not called
+func AuthInterceptor(key string, validate func(token string) (principal interface{}, err error)) Interceptor {
+	if key == "" {
+		key = protocol.Meta_Auth
+	}
+	return func(ctx context.Context, method string, args interface{}, next Invoker) (interface{}, error) {
+		req := RequestFromContext(ctx)
+		if req == nil {
+			return nil, protocol.NewRPCError(protocol.Err_Code_Unauthenticated, "rpc: method " + method + " has no request")
+		}
+		token, ok := req.GetMeta(key)
+		if !ok || token == "" {
+			return nil, protocol.NewRPCError(protocol.Err_Code_Unauthenticated, "rpc: method " + method + " requires a token")
+		}
+		principal, err := validate(token)
+		if err != nil {
+			return nil, protocol.NewRPCError(protocol.Err_Code_Unauthenticated, "rpc: invalid token: " + err.Error())
+		}
+		return next(context.WithValue(ctx, principalKey{}, principal), args)
+	}
+}
+
+// PrincipalFromContext returns the principal the AuthInterceptor validated, nil if none
+func PrincipalFromContext(ctx context.Context) interface{} {
+	return ctx.Value(principalKey{})
+}
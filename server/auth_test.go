@@ -0,0 +1,71 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"errors"
+	"context"
+	"github.com/phachon/kitten/protocol"
+)
+
+// call the method with the auth token, no token if empty
+func callAuth(t *testing.T, conn net.Conn, seq uint64, method string, token string) *protocol.Message {
+	req := protocol.NewMessage()
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.Header.SetSeq(seq)
+	req.SetMethod(method)
+	if token != "" {
+		req.MetaData[protocol.Meta_Auth] = token
+	}
+	_, err := req.WriteTo(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := protocol.ReadMessage(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return res
+}
+
+func TestAuthInterceptor(t *testing.T) {
+
+	server := NewServer()
+	called := 0
+	server.Handle("User.Name", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		called++
+		name, _ := PrincipalFromContext(ctx).(string)
+		res.SetPayload([]byte(name))
+		return nil
+	})
+	server.Use(AuthInterceptor("", func(token string) (interface{}, error) {
+		if token != "secret" {
+			return nil, errors.New("unknown token")
+		}
+		return "kitten", nil
+	}))
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	res := callAuth(t, clientConn, 1, "User.Name", "secret")
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal || string(res.Payload) != "kitten" {
+		t.Fatal("handler must see the principal of the valid token")
+	}
+
+	res = callAuth(t, clientConn, 2, "User.Name", "")
+	rpcErr := res.RPCError()
+	if rpcErr == nil || rpcErr.Code != protocol.Err_Code_Unauthenticated {
+		t.Fatal("missing token must be unauthenticated")
+	}
+
+	res = callAuth(t, clientConn, 3, "User.Name", "guess")
+	rpcErr = res.RPCError()
+	if rpcErr == nil || rpcErr.Code != protocol.Err_Code_Unauthenticated {
+		t.Fatal("invalid token must be unauthenticated")
+	}
+	if called != 1 {
+		t.Fatal("handler must not run without a valid token")
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const debugText = `<html>
+	<body>
+	<title>Kitten Services</title>
+	<table>
+	<th align=center>Method</th><th align=center>Calls</th><th align=center>Errors</th><th align=center>Avg Latency</th>
+	{{range .}}
+	<tr>
+	<td align=left font=fixed>{{.Name}}</td>
+	<td align=center>{{.Calls}}</td>
+	<td align=center>{{.Errors}}</td>
+	<td align=center>{{.AvgLatency}}</td>
+	</tr>
+	{{end}}
+	</table>
+	</body>
+	</html>`
+
+var debugTemplate = template.Must(template.New("RPC debug").Parse(debugText))
+
+// call stats of a method
+type callStats struct {
+	calls int64
+	errors int64
+	latency time.Duration
+}
+
+// debug stats of the served methods
+type debugStats struct {
+	lock sync.Mutex
+	methods map[string]*callStats
+}
+
+// record a dispatched call of the method
+func (d *debugStats) record(method string, err error, latency time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.methods == nil {
+		d.methods = make(map[string]*callStats)
+	}
+	stats, ok := d.methods[method]
+	if !ok {
+		stats = &callStats{}
+		d.methods[method] = stats
+	}
+	stats.calls++
+	if err != nil {
+		stats.errors++
+	}
+	stats.latency += latency
+}
+
+// is the method registered, only registered methods are recorded
+func (server *Server) registered(method string) bool {
+	server.handlerLock.RLock()
+	defer server.handlerLock.RUnlock()
+	method = server.methodName(method)
+	_, ok := server.handlers[method]
+	if !ok {
+		_, ok = server.methods[method]
+	}
+	return ok
+}
+
+// a row of the debug page
+type debugMethod struct {
+	Name string
+	Calls int64
+	Errors int64
+	AvgLatency time.Duration
+}
+
+// registered methods and their call stats, sorted by name
+func (server *Server) debugMethods() []debugMethod {
+	server.handlerLock.RLock()
+	names := make([]string, 0, len(server.handlers) + len(server.methods))
+	for name := range server.handlers {
+		names = append(names, name)
+	}
+	for name := range server.methods {
+		names = append(names, name)
+	}
+	server.handlerLock.RUnlock()
+	sort.Strings(names)
+
+	server.debugStats.lock.Lock()
+	defer server.debugStats.lock.Unlock()
+	methods := make([]debugMethod, len(names))
+	for i, name := range names {
+		methods[i].Name = name
+		stats, ok := server.debugStats.methods[name]
+		if !ok {
+			continue
+		}
+		methods[i].Calls = stats.calls
+		methods[i].Errors = stats.errors
+		if stats.calls > 0 {
+			methods[i].AvgLatency = stats.latency / time.Duration(stats.calls)
+		}
+	}
+	return methods
+}
+
+// serve the debug page of the registered methods, only GET is allowed
+func (server *Server) serveDebug(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must GET\n")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := debugTemplate.Execute(w, server.debugMethods())
+	if err != nil {
+		fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"testing"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	"github.com/phachon/kitten/protocol"
+)
+
+func TestDebugHTTP(t *testing.T) {
+
+	server := NewServer()
+	err := server.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server.Handle("Echo.Fail", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		return errors.New("echo fail")
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+	call(t, clientConn, 1, "Echo.Fail", nil)
+	call(t, clientConn, 2, "Echo.Unknown", nil)
+
+	// stats are recorded after the response is written
+	var failStats debugMethod
+	for i := 0; i < 100; i++ {
+		for _, m := range server.debugMethods() {
+			if m.Name == "Echo.Fail" {
+				failStats = m
+			}
+		}
+		if failStats.Calls == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if failStats.Calls != 1 || failStats.Errors != 1 {
+		t.Fatal("debug call stats error")
+	}
+
+	w := httptest.NewRecorder()
+	server.serveDebug(w, httptest.NewRequest("GET", Http_Path_Debug, nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("debug page must return 200")
+	}
+	body := w.Body.String()
+	for _, method := range []string{"Arith.Add", "Arith.Mul", "Echo.Fail"} {
+		if !strings.Contains(body, method) {
+			t.Fatal("debug page must list " + method)
+		}
+	}
+	if strings.Contains(body, "Echo.Unknown") {
+		t.Fatal("debug page must not list unknown methods")
+	}
+}
+
+func TestHandleHttp(t *testing.T) {
+
+	server := NewServer()
+	server.Handle("Echo.Ping", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		return nil
+	})
+	server.HandleHttp("/test"+Http_Path_Rpc, "/test"+Http_Path_Debug)
+	ts := httptest.NewServer(http.DefaultServeMux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/test" + Http_Path_Debug)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("GET on the debug path must return 200")
+	}
+
+	resp, err = http.Get(ts.URL + "/test" + Http_Path_Rpc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("GET on the rpc path must return 405")
+	}
+
+	// the stream path is mounted for POST streams
+	resp, err = http.Get(ts.URL + Http_Path_Stream)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("GET on the stream path must return 405")
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"github.com/phachon/kitten/protocol"
+)
+
+// is the request a version handshake, only the first message of a connection is checked
+func isHandshake(req *protocol.Message) bool {
+	_, hasMin := req.MetaData[protocol.Meta_Min_Version]
+	_, hasMax := req.MetaData[protocol.Meta_Max_Version]
+	return hasMin && hasMax && req.Header.MessageType() == protocol.Message_Type_Request
+}
+
+// answer the handshake with the agreed version in the response header,
+// return false if no version is agreed, the exception response is written and the conn should be closed
+func (c *connection) handshake(req *protocol.Message) bool {
+	res := protocol.NewMessage()
+	res.Header.SetVersion(req.Header.Version())
+	res.Header.SetMessageType(protocol.Message_Type_Response)
+	res.Header.SetSeq(req.Header.Seq())
+
+	version, err := negotiateVersion(req)
+	if err != nil {
+		c.server.logger().Warnf("rpc handshake %s: %s", c.conn.RemoteAddr(), err.Error())
+		res.Header.SetMessageStatusType(protocol.Message_Status_Exception)
+		res.SetPayload([]byte(err.Error()))
+		c.writeResponse(res)
+		return false
+	}
+	res.Header.SetVersion(version)
+	_, err = c.writeResponse(res)
+	return err == nil
+}
+
+// the highest version supported by both the client and the server
+func negotiateVersion(req *protocol.Message) (byte, error) {
+	minVersion, err := strconv.ParseUint(req.MetaData[protocol.Meta_Min_Version], 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("rpc: invalid handshake min version %q", req.MetaData[protocol.Meta_Min_Version])
+	}
+	maxVersion, err := strconv.ParseUint(req.MetaData[protocol.Meta_Max_Version], 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("rpc: invalid handshake max version %q", req.MetaData[protocol.Meta_Max_Version])
+	}
+
+	version := byte(maxVersion)
+	if version > protocol.Max_Version {
+		version = protocol.Max_Version
+	}
+	if version < byte(minVersion) || version < protocol.Min_Version {
+		return 0, fmt.Errorf("rpc: unsupported protocol version %d-%d, server supports %d-%d",
+			minVersion, maxVersion, protocol.Min_Version, protocol.Max_Version)
+	}
+	return version, nil
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"strconv"
+	"strings"
+	"github.com/phachon/kitten/protocol"
+)
+
+// write a handshake request of the version range and read the response
+func handshake(t *testing.T, conn net.Conn, minVersion, maxVersion byte) *protocol.Message {
+	req := protocol.NewMessage()
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.MetaData[protocol.Meta_Min_Version] = strconv.Itoa(int(minVersion))
+	req.MetaData[protocol.Meta_Max_Version] = strconv.Itoa(int(maxVersion))
+	_, err := req.WriteTo(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := protocol.ReadMessage(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return res
+}
+
+func TestHandshake(t *testing.T) {
+
+	server := NewServer()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+
+	res := handshake(t, clientConn, protocol.Min_Version, protocol.Max_Version)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal("handshake response error")
+	}
+	if res.Header.Version() != protocol.Max_Version {
+		t.Fatal("handshake version false")
+	}
+
+	// handshake is only the first message, later ones are dispatched
+	res = handshake(t, clientConn, protocol.Min_Version, protocol.Max_Version)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception {
+		t.Fatal("second handshake must be dispatched")
+	}
+	if !strings.Contains(string(res.Payload), "can't find method") {
+		t.Fatal("second handshake must not be answered as handshake")
+	}
+
+	// no agreed version, the connection is closed
+	serverConn, clientConn = net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	res = handshake(t, clientConn, protocol.Max_Version+1, protocol.Max_Version+1)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception {
+		t.Fatal("mismatched version must return exception")
+	}
+	_, err := protocol.ReadMessage(clientConn)
+	if err == nil {
+		t.Fatal("mismatched version connection must be closed")
+	}
+}
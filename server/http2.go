@@ -0,0 +1,126 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	Http_Path_Stream = "/_kittenStream_"
+)
+
+// ServeHTTP2 implements an http.HandlerFunc tunneling the rpc over the bidirectional stream of a POST,
+// for clients behind proxies forbidding CONNECT. the request body carries the request frames and
+// the response body the response frames, like a connection of ServeConn. the stream must be HTTP/2,
+// or HTTP/1.1 of a server supporting full duplex
+func (server *Server) ServeHTTP2(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must POST\n")
+		return
+	}
+	if server.shuttingDown() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "503 server is shutting down\n")
+		return
+	}
+	rc := http.NewResponseController(w)
+	if req.ProtoMajor < 2 {
+		err := rc.EnableFullDuplex()
+		if err != nil {
+			server.logger().Errorf("rpc http stream %s: %s", req.RemoteAddr, err.Error())
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "500 connection does not support full duplex streams\n")
+			return
+		}
+	}
+	if !server.acquireConn() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "503 too many connections\n")
+		return
+	}
+	defer server.releaseConn()
+
+	// the client waits for the response headers before sending requests
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	err := rc.Flush()
+	if err != nil {
+		server.logger().Errorf("rpc http stream %s: %s", req.RemoteAddr, err.Error())
+		return
+	}
+	remoteAddr := streamAddr(req.RemoteAddr)
+	server.serveConn(&streamConn{
+		body: req.Body,
+		w: w,
+		rc: rc,
+		remoteAddr: remoteAddr,
+	}, remoteAddr)
+}
+
+// net.Conn of the request and response bodies of an http stream
+type streamConn struct {
+	body io.ReadCloser
+	w io.Writer
+	rc *http.ResponseController
+	remoteAddr net.Addr
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+// write and flush the response body, the frames are buffered by protocol.Conn
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// close the request body, the response ends when ServeHTTP2 returns
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return streamAddr("")
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	err := c.rc.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// address of an http request, the http request remote address
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "http"
+}
+
+func (a streamAddr) String() string {
+	return string(a)
+}
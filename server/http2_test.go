@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+	"io"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"github.com/phachon/kitten/protocol"
+)
+
+func TestServeHTTP2(t *testing.T) {
+
+	server := NewServer()
+	server.Handle("Echo.Echo", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(req.Payload)
+		return nil
+	})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(server.ServeHTTP2))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	body, w := io.Pipe()
+	defer w.Close()
+	httpReq, err := http.NewRequest("POST", ts.URL + Http_Path_Stream, body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp, err := ts.Client().Do(httpReq)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatal("stream must be an HTTP/2 200")
+	}
+
+	for seq := uint64(1); seq <= 2; seq++ {
+		req := protocol.NewMessage()
+		req.Header.SetMessageType(protocol.Message_Type_Request)
+		req.Header.SetSeq(seq)
+		req.SetMethod("Echo.Echo")
+		req.SetPayload([]byte("kitten"))
+		go req.WriteTo(w)
+
+		res, err := protocol.ReadMessage(resp.Body)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.Header.Seq() != seq || string(res.Payload) != "kitten" {
+			t.Fatal("response over the stream error")
+		}
+	}
+
+	// only POST streams
+	res, err := ts.Client().Get(ts.URL + Http_Path_Stream)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("GET must be 405")
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"github.com/phachon/kitten/protocol"
+)
+
+// Invoker invoke the handler with the args, return the reply
+type Invoker func(ctx context.Context, args interface{}) (reply interface{}, err error)
+
+// Interceptor intercept every dispatched call, call next to continue the chain,
+// return without calling next to short-circuit the handler.
+// for handlers of Handle, args is the request *protocol.Message and reply is the response *protocol.Message,
+// for methods of Register, args is the decoded argument and reply is the reply pointer
+type Interceptor func(ctx context.Context, method string, args interface{}, next Invoker) (reply interface{}, err error)
+
+// Use append the interceptors to the chain, the chain runs outermost-first in the order of use
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.handlerLock.Lock()
+	defer server.handlerLock.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// chain the interceptors around the invoker of the method
+func (server *Server) chain(method string, invoker Invoker) Invoker {
+	server.handlerLock.RLock()
+	interceptors := server.interceptors
+	server.handlerLock.RUnlock()
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, args interface{}) (interface{}, error) {
+			return interceptor(ctx, method, args, next)
+		}
+	}
+	return invoker
+}
+
+// call the handler with the request through the interceptors
+func (server *Server) callHandler(ctx context.Context, method string, handler Handler, req *protocol.Message, res *protocol.Message) error {
+	_, err := server.chain(method, func(ctx context.Context, args interface{}) (interface{}, error) {
+		return res, handler(ctx, args.(*protocol.Message), res)
+	})(context.WithValue(ctx, responseKey{}, res), req)
+	return err
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"errors"
+	"context"
+	"encoding/json"
+	"github.com/phachon/kitten/protocol"
+)
+
+func TestInterceptor(t *testing.T) {
+
+	server := NewServer()
+	err := server.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var order []string
+	server.Use(func(ctx context.Context, method string, args interface{}, next Invoker) (interface{}, error) {
+		order = append(order, "outer:"+method)
+		reply, err := next(ctx, args)
+		order = append(order, "outer:end")
+		return reply, err
+	}, func(ctx context.Context, method string, args interface{}, next Invoker) (interface{}, error) {
+		order = append(order, "inner:"+method)
+		if method == "Arith.Add" && args.(Args).A < 0 {
+			return nil, errors.New("negative args")
+		}
+		return next(ctx, args)
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	res := callJson(t, clientConn, 1, "Arith.Add", Args{1, 2})
+	reply := new(Reply)
+	err = json.Unmarshal(res.Payload, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 3 {
+		t.Fatal("reply error")
+	}
+	expect := []string{"outer:Arith.Add", "inner:Arith.Add", "outer:end"}
+	if len(order) != len(expect) {
+		t.Fatal("interceptor order error")
+	}
+	for i := range expect {
+		if order[i] != expect[i] {
+			t.Fatal("interceptor order error")
+		}
+	}
+
+	// short-circuit
+	res = callJson(t, clientConn, 2, "Arith.Add", Args{-1, 2})
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception || string(res.Payload) != "negative args" {
+		t.Fatal("short-circuit interceptor must return exception")
+	}
+}
+
+func TestInterceptorShortCircuitHandler(t *testing.T) {
+
+	server := NewServer()
+	called := false
+	server.Handle("Echo.Secret", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		called = true
+		return nil
+	})
+	server.Use(func(ctx context.Context, method string, args interface{}, next Invoker) (interface{}, error) {
+		if _, ok := args.(*protocol.Message); !ok {
+			return nil, errors.New("args must be request message")
+		}
+		return nil, errors.New("denied")
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	res := call(t, clientConn, 1, "Echo.Secret", nil)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception || string(res.Payload) != "denied" {
+		t.Fatal("short-circuit interceptor must return exception")
+	}
+	if called {
+		t.Fatal("short-circuit interceptor must prevent handler invocation")
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+// concurrency limit of a method
+type concurrencyLimit struct {
+	// running calls
+	sem chan struct{}
+	// running and queued calls
+	admit chan struct{}
+}
+
+// SetConcurrency limit the method to max calls at a time, up to queue more calls wait for a running
+// call to finish and further calls get a protocol.Err_Code_Unavailable exception at once.
+// max 0 removes the limit, methods without a limit run unbounded
+func (server *Server) SetConcurrency(method string, max int, queue int) {
+	server.handlerLock.Lock()
+	defer server.handlerLock.Unlock()
+	if max <= 0 {
+		delete(server.limits, method)
+		return
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	if server.limits == nil {
+		server.limits = make(map[string]*concurrencyLimit)
+	}
+	server.limits[method] = &concurrencyLimit{
+		sem: make(chan struct{}, max),
+		admit: make(chan struct{}, max + queue),
+	}
+}
+
+// acquire a call of the method limit, wait in the queue until ctx is done,
+// return the release func or an error if the queue is full
+func (server *Server) acquireCall(ctx context.Context, method string) (func(), error) {
+	server.handlerLock.RLock()
+	limit := server.limits[method]
+	server.handlerLock.RUnlock()
+	if limit == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case limit.admit <- struct{}{}:
+	default:
+		return nil, protocol.NewRPCError(protocol.Err_Code_Unavailable, "rpc: method " + method + " is over its concurrency limit")
+	}
+	select {
+	case limit.sem <- struct{}{}:
+	case <-ctx.Done():
+		<-limit.admit
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-limit.sem
+		<-limit.admit
+	}, nil
+}
+
+// payload limits of a method, 0 means no limit
+type payloadLimit struct {
+	request uint32
+	response uint32
+}
+
+// SetPayloadLimit limit the payload length of the requests and responses of the method, 0 means no limit.
+// a longer request payload is discarded without reading it into memory, a longer response payload
+// is not written, both are answered with a protocol.Err_Code_Payload_Too_Large exception
+func (server *Server) SetPayloadLimit(method string, maxRequest uint32, maxResponse uint32) {
+	server.handlerLock.Lock()
+	defer server.handlerLock.Unlock()
+	if maxRequest == 0 && maxResponse == 0 {
+		delete(server.payloadLimits, method)
+		return
+	}
+	if server.payloadLimits == nil {
+		server.payloadLimits = make(map[string]payloadLimit)
+	}
+	server.payloadLimits[method] = payloadLimit{request: maxRequest, response: maxResponse}
+}
+
+// payload limit of the method
+func (server *Server) payloadLimit(method string) payloadLimit {
+	server.handlerLock.RLock()
+	defer server.handlerLock.RUnlock()
+	return server.payloadLimits[method]
+}
+
+// max request payload length of the request meta data, for protocol.ReadOptions
+func (server *Server) requestPayloadLimit(meta map[string]string) uint32 {
+	server.handlerLock.RLock()
+	method := server.methodName(meta[protocol.Meta_Method])
+	server.handlerLock.RUnlock()
+	return server.payloadLimit(method).request
+}
+
+// answer the request of the discarded payload, one way request has no response
+func (c *connection) rejectPayload(req *protocol.Message) {
+	method := req.Method()
+	c.server.logger().Warnf("rpc method %s: request payload too large", method)
+	start := time.Now()
+	res := newResponse(req)
+	setError(res, protocol.NewRPCError(protocol.Err_Code_Payload_Too_Large, "rpc: request payload of method " + method + " is too large"))
+	if !req.Header.IsOneWay() {
+		c.writeResponse(res)
+	}
+	c.accessLog(req, res, start)
+}
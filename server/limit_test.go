@@ -0,0 +1,149 @@
+package server
+
+import (
+	"testing"
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+// write requests of the method with seq from to n
+func writeRequests(conn net.Conn, method string, from int, n int) {
+	for seq := from; seq <= n; seq++ {
+		req := protocol.NewMessage()
+		req.Header.SetMessageType(protocol.Message_Type_Request)
+		req.Header.SetSeq(uint64(seq))
+		req.SetMetaData(map[string]string{protocol.Meta_Method: method})
+		req.WriteTo(conn)
+	}
+}
+
+func TestSetConcurrency(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+	var running, maxRunning int32
+	server.Handle("DB.Query", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		if n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	server.SetConcurrency("DB.Query", 1, 1)
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	start := time.Now()
+	go writeRequests(clientConn, "DB.Query", 1, 2)
+	for i := 0; i < 2; i++ {
+		res, err := protocol.ReadMessage(clientConn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+			t.Fatal("queued call must be served")
+		}
+	}
+	if atomic.LoadInt32(&maxRunning) != 1 || time.Since(start) < 100 * time.Millisecond {
+		t.Fatal("calls of the method must be serialized")
+	}
+}
+
+func TestSetConcurrencyUnavailable(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+	started := make(chan struct{})
+	block := make(chan struct{})
+	server.Handle("DB.Query", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		close(started)
+		<-block
+		return nil
+	})
+	server.Handle("Echo.Ping", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		return nil
+	})
+	server.SetConcurrency("DB.Query", 1, 0)
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	// the first call runs, the second is over the limit
+	go writeRequests(clientConn, "DB.Query", 1, 1)
+	<-started
+	go writeRequests(clientConn, "DB.Query", 2, 2)
+	res, err := protocol.ReadMessage(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rpcErr := res.RPCError()
+	if rpcErr == nil || rpcErr.Code != protocol.Err_Code_Unavailable || res.Header.Seq() != 2 {
+		t.Fatal("call over the limit must be unavailable")
+	}
+
+	// methods without a limit are not throttled
+	res = call(t, clientConn, 3, "Echo.Ping", nil)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal("method without a limit must be served")
+	}
+
+	close(block)
+	res, err = protocol.ReadMessage(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.Seq() != 1 || res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal("running call must be served")
+	}
+}
+
+func TestSetPayloadLimit(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+	server.Handle("Echo.Echo", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(req.Payload)
+		return nil
+	})
+	server.Handle("Echo.Repeat", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(bytes.Repeat(req.Payload, 2))
+		return nil
+	})
+	server.SetPayloadLimit("Echo.Echo", 1024, 0)
+	server.SetPayloadLimit("Echo.Repeat", 0, 1024)
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	res := call(t, clientConn, 1, "Echo.Echo", bytes.Repeat([]byte("k"), 2048))
+	rpcErr := res.RPCError()
+	if rpcErr == nil || rpcErr.Code != protocol.Err_Code_Payload_Too_Large || res.Header.Seq() != 1 {
+		t.Fatal("request payload over the limit must be rejected")
+	}
+
+	// the connection is still usable
+	res = call(t, clientConn, 2, "Echo.Echo", []byte("kitten"))
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal || string(res.Payload) != "kitten" {
+		t.Fatal("request payload under the limit must be served")
+	}
+
+	res = call(t, clientConn, 3, "Echo.Repeat", bytes.Repeat([]byte("k"), 600))
+	rpcErr = res.RPCError()
+	if rpcErr == nil || rpcErr.Code != protocol.Err_Code_Payload_Too_Large {
+		t.Fatal("response payload over the limit must be rejected")
+	}
+	res = call(t, clientConn, 4, "Echo.Repeat", []byte("kitten"))
+	if string(res.Payload) != "kittenkitten" {
+		t.Fatal("response payload under the limit must be served")
+	}
+}
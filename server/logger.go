@@ -0,0 +1,35 @@
+package server
+
+import (
+	"log"
+)
+
+// Logger leveled logger of the server
+type Logger interface {
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// default logger, write to the standard logger
+type stdLogger struct{}
+
+func (l stdLogger) Infof(format string, v ...interface{}) {
+	log.Printf("[INFO] "+format, v...)
+}
+
+func (l stdLogger) Warnf(format string, v ...interface{}) {
+	log.Printf("[WARN] "+format, v...)
+}
+
+func (l stdLogger) Errorf(format string, v ...interface{}) {
+	log.Printf("[ERROR] "+format, v...)
+}
+
+// logger of the server, the standard logger if not set
+func (server *Server) logger() Logger {
+	if server.Logger == nil {
+		return stdLogger{}
+	}
+	return server.Logger
+}
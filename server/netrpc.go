@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"encoding/json"
+	"github.com/phachon/kitten/protocol"
+)
+
+// invalid request body sent with an error response
+var invalidRequest = struct{}{}
+
+// ServeCodec serve the standard library net/rpc protocol with the codec so that
+// existing net/rpc clients can call the server. The ServiceMethod and Seq of every
+// request are mapped onto the __METHOD meta and the Seq of a kitten request message,
+// the body is passed through as a json payload, so the codec must decode the body
+// into *json.RawMessage and encode json.RawMessage, like net/rpc/jsonrpc
+func (server *Server) ServeCodec(codec rpc.ServerCodec) {
+	defer codec.Close()
+
+	var sending sync.Mutex
+	var wg sync.WaitGroup
+	for {
+		var header rpc.Request
+		err := codec.ReadRequestHeader(&header)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				server.logger().Errorf("rpc read request header: %s", err.Error())
+			}
+			break
+		}
+		var body json.RawMessage
+		err = codec.ReadRequestBody(&body)
+		if err != nil {
+			server.logger().Errorf("rpc read request body: %s", err.Error())
+			break
+		}
+
+		req := protocol.NewMessage()
+		req.Header.SetMessageType(protocol.Message_Type_Request)
+		req.Header.SetSerializeType(protocol.Serialize_Json)
+		req.Header.SetSeq(header.Seq)
+		req.SetMethod(header.ServiceMethod)
+		req.SetPayload(body)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, _ := server.dispatch(req, nil)
+
+			resHeader := &rpc.Response{
+				ServiceMethod: req.Method(),
+				Seq: res.Header.Seq(),
+			}
+			var reply interface{}
+			if res.Header.MessageStatusType() == protocol.Message_Status_Exception {
+				resHeader.Error = string(res.Payload)
+				reply = invalidRequest
+			}else {
+				reply = json.RawMessage(res.Payload)
+			}
+
+			sending.Lock()
+			err := codec.WriteResponse(resHeader, reply)
+			sending.Unlock()
+			if err != nil {
+				server.logger().Errorf("rpc write response: %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ServeJsonRpc serve net/rpc/jsonrpc clients on the conn
+func (server *Server) ServeJsonRpc(conn io.ReadWriteCloser) {
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
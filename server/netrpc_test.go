@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+)
+
+func TestServeJsonRpc(t *testing.T) {
+
+	server := NewServer()
+	err := server.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeJsonRpc(serverConn)
+
+	client := jsonrpc.NewClient(clientConn)
+	defer client.Close()
+
+	reply := new(Reply)
+	err = client.Call("Arith.Add", Args{7, 8}, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 15 {
+		t.Fatal("reply error")
+	}
+
+	err = client.Call("Arith.Div", Args{7, 0}, reply)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "divide by zero" {
+		t.Fatal("handler error must be server error")
+	}
+
+	// concurrent calls
+	calls := make([]*rpc.Call, 10)
+	for i := range calls {
+		calls[i] = client.Go("Arith.Mul", &Args{i, 2}, new(Reply), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			t.Fatal(call.Error.Error())
+		}
+		if call.Reply.(*Reply).C != i*2 {
+			t.Fatal("reply error")
+		}
+	}
+}
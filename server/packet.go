@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net"
+	"github.com/phachon/kitten/protocol"
+)
+
+// ServePacket serve one way requests of the datagrams read from the conn, e.g. of net.ListenPacket("udp", addr),
+// until the conn is closed. every datagram holds a single whole message of at most protocol.Max_Packet_Len bytes,
+// the sender writes the Encode of a one way request per datagram. requests are dispatched like the
+// requests of ServeConn with no response, datagrams of a request with a response are dropped
+func (server *Server) ServePacket(conn net.PacketConn) error {
+	buf := make([]byte, protocol.Max_Packet_Len)
+	opts := protocol.ReadOptions{
+		AuthKey: server.AuthKey,
+		ByteOrder: server.ByteOrder,
+		MagicNumber: server.MagicNumber,
+	}
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		req, err := protocol.ReadPacketOptions(buf[:n], opts)
+		if err != nil {
+			server.logger().Errorf("rpc read packet %s: %s", addr, err.Error())
+			continue
+		}
+		if !req.Header.IsOneWay() || req.Header.IsHeartBeat() {
+			server.logger().Warnf("rpc packet %s: only one way requests are served", addr)
+			continue
+		}
+		go server.dispatch(req, addr)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+	"context"
+	"net"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+func TestServePacket(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+	received := make(chan string, 1)
+	server.Handle("Log.Write", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		received <- string(req.Payload)
+		return nil
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServePacket(pc)
+	}()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	// a request with a response is dropped, the one way request runs
+	for _, oneWay := range []bool{false, true} {
+		req := protocol.NewMessage()
+		req.Header.SetMessageType(protocol.Message_Type_Request)
+		req.Header.SetOneWay(oneWay)
+		req.SetMethod("Log.Write")
+		req.SetPayload([]byte("kitten"))
+		if !oneWay {
+			req.SetPayload([]byte("dropped"))
+		}
+		data, err := req.Encode()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = conn.Write(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	select {
+	case payload := <-received:
+		if payload != "kitten" {
+			t.Fatal("request with a response must be dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("one way packet handler did not run")
+	}
+
+	pc.Close()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Fatal("closed packet conn must return the error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve packet did not return after close")
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// max length of a PROXY protocol v1 header line, including the CRLF
+	Proxy_Header_Max_Len int = 107
+)
+
+// ErrInvalidProxyHeader is returned for a connection without a valid PROXY protocol v1 header
+var ErrInvalidProxyHeader = errors.New("rpc: invalid PROXY protocol header")
+
+// read the PROXY protocol v1 header line off r, return the source address, nil for PROXY UNKNOWN.
+// r is read byte by byte so nothing after the line is consumed, it should be buffered
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == Proxy_Header_Max_Len {
+			return nil, ErrInvalidProxyHeader
+		}
+	}
+	return parseProxyHeader(string(line))
+}
+
+// parse the PROXY protocol v1 header line like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func parseProxyHeader(line string) (net.Addr, error) {
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, ErrInvalidProxyHeader
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrInvalidProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, ErrInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	_, err = strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// read the PROXY protocol header of the connection, false if it is invalid
+func (c *connection) readProxyHeader() bool {
+	if c.server.ReadTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.server.ReadTimeout))
+	}
+	addr, err := readProxyHeader(c.conn)
+	if err != nil {
+		c.server.logger().Errorf("rpc read proxy header %s: %s", c.conn.RemoteAddr(), err.Error())
+		return false
+	}
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"io"
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"github.com/phachon/kitten/protocol"
+)
+
+func TestProxyProtocol(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+	server.ProxyProtocol = true
+	server.Handle("Echo.Addr", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload([]byte(RemoteAddrFromContext(ctx).String()))
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	_, err := clientConn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res := call(t, clientConn, 1, "Echo.Addr", nil)
+	if string(res.Payload) != "203.0.113.7:56324" {
+		t.Fatal("handler must see the source address of the proxy header")
+	}
+
+	// a connection with an invalid header is closed
+	serverConn, clientConn = net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+	go clientConn.Write([]byte("HELLO\r\n"))
+	_, err = protocol.ReadMessage(clientConn)
+	if err != io.EOF {
+		t.Fatal("connection with an invalid proxy header must be closed")
+	}
+}
+
+func TestProxyProtocolHTTP(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+	server.ProxyProtocol = true
+	server.Handle("Echo.Addr", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload([]byte(RemoteAddrFromContext(ctx).String()))
+		return nil
+	})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	// the hijacked connection has no proxy header, the address is the http request one
+	conn, err := net.Dial("tcp", httpServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+Http_Path_Rpc+" HTTP/1.0\n\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.Status != connected {
+		t.Fatal("unexpected http response: " + resp.Status)
+	}
+	req := protocol.NewMessage()
+	req.Header.SetSeq(1)
+	req.SetMetaData(map[string]string{protocol.Meta_Method: "Echo.Addr"})
+	_, err = req.WriteTo(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := protocol.ReadMessage(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(res.Payload) != conn.LocalAddr().String() {
+		t.Fatal("handler must see the remote address of the http request")
+	}
+}
+
+func TestParseProxyHeader(t *testing.T) {
+
+	addr, err := parseProxyHeader("PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n")
+	if err != nil || addr.String() != "[2001:db8::1]:4000" {
+		t.Fatal("tcp6 header error")
+	}
+	addr, err = parseProxyHeader("PROXY UNKNOWN\r\n")
+	if err != nil || addr != nil {
+		t.Fatal("unknown header must keep the connection address")
+	}
+	for _, line := range []string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 56324 443\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 70000 443\r\n",
+		"PROXY UDP4 203.0.113.7 10.0.0.1 56324 443\r\n",
+		"HELLO\r\n",
+	} {
+		if _, err := parseProxyHeader(line); err != ErrInvalidProxyHeader {
+			t.Fatalf("header %q must be invalid", line)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+// Limiter allow or deny a call of the caller key, safe for concurrent use
+type Limiter interface {
+	Allow(key string) bool
+}
+
+// TokenBucket Limiter of a token bucket per key, a bucket holds up to burst tokens
+// and refills rate tokens per second, a call takes a token. the idle buckets refilled
+// to burst are evicted, a new bucket is full
+type TokenBucket struct {
+	rate float64
+	burst float64
+
+	mutex sync.Mutex
+	buckets map[string]*bucket
+	// last eviction of the full buckets
+	swept time.Time
+}
+
+// tokens of a key at the time
+type bucket struct {
+	tokens float64
+	time time.Time
+}
+
+// NewTokenBucket returns a new TokenBucket of rate tokens per second and burst tokens per key
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate: rate,
+		burst: float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow take a token of the key bucket, false if the bucket is empty
+func (tb *TokenBucket) Allow(key string) bool {
+	now := time.Now()
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.sweep(now)
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &bucket{tokens: tb.burst, time: now}
+		tb.buckets[key] = b
+	}else {
+		b.tokens += now.Sub(b.time).Seconds() * tb.rate
+		if b.tokens > tb.burst {
+			b.tokens = tb.burst
+		}
+		b.time = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict the buckets refilled to burst, at most once per the refill time of an empty bucket
+func (tb *TokenBucket) sweep(now time.Time) {
+	if tb.rate <= 0 {
+		return
+	}
+	refill := time.Duration(tb.burst / tb.rate * float64(time.Second))
+	if now.Sub(tb.swept) < refill {
+		return
+	}
+	tb.swept = now
+	for key, b := range tb.buckets {
+		if b.tokens + now.Sub(b.time).Seconds() * tb.rate >= tb.burst {
+			delete(tb.buckets, key)
+		}
+	}
+}
+
+// RateLimitInterceptor returns an Interceptor allowing the calls the limiter allows for the caller key,
+// further calls get a protocol.Err_Code_Resource_Exhausted exception and the handler is not called.
+// the key is the principal of the AuthInterceptor if any, otherwise the remote host of the connection
+func RateLimitInterceptor(limiter Limiter) Interceptor {
+	return func(ctx context.Context, method string, args interface{}, next Invoker) (interface{}, error) {
+		if !limiter.Allow(callerKey(ctx)) {
+			return nil, protocol.NewRPCError(protocol.Err_Code_Resource_Exhausted, "rpc: method " + method + " is over the rate limit")
+		}
+		return next(ctx, args)
+	}
+}
+
+// caller key of the context, the principal or the remote host, the connections of a host
+// share the bucket. the whole remote address if it has no port, empty if unknown
+func callerKey(ctx context.Context) string {
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		return fmt.Sprint(principal)
+	}
+	if addr := RemoteAddrFromContext(ctx); addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		return host
+	}
+	return ""
+}
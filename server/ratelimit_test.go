@@ -0,0 +1,128 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"context"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+// limiter recording the keys of the calls
+type keyLimiter struct {
+	limiter Limiter
+	keys []string
+}
+
+func (l *keyLimiter) Allow(key string) bool {
+	l.keys = append(l.keys, key)
+	return l.limiter.Allow(key)
+}
+
+func TestRateLimitInterceptor(t *testing.T) {
+
+	server := NewServer()
+	called := 0
+	server.Handle("Echo.Ping", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		called++
+		return nil
+	})
+	// no refill during the test
+	limiter := &keyLimiter{limiter: NewTokenBucket(0.001, 2)}
+	server.Use(RateLimitInterceptor(limiter))
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		res := call(t, clientConn, seq, "Echo.Ping", nil)
+		rpcErr := res.RPCError()
+		if seq <= 2 && res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+			t.Fatal("call under the rate must be served")
+		}
+		if seq == 3 && (rpcErr == nil || rpcErr.Code != protocol.Err_Code_Resource_Exhausted) {
+			t.Fatal("call over the rate must be resource exhausted")
+		}
+	}
+	if called != 2 {
+		t.Fatal("handler must not run over the rate")
+	}
+	if len(limiter.keys) != 3 || limiter.keys[0] != serverConn.RemoteAddr().String() {
+		t.Fatal("calls must be keyed by the remote address")
+	}
+}
+
+func TestRateLimitPrincipal(t *testing.T) {
+
+	server := NewServer()
+	server.Handle("Echo.Ping", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		return nil
+	})
+	server.Use(AuthInterceptor("", func(token string) (interface{}, error) {
+		return "user:" + token, nil
+	}), RateLimitInterceptor(NewTokenBucket(0.001, 1)))
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	// each principal has its own bucket on the same connection
+	res := callAuth(t, clientConn, 1, "Echo.Ping", "a")
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal("first call of a must be served")
+	}
+	res = callAuth(t, clientConn, 2, "Echo.Ping", "b")
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal("first call of b must be served")
+	}
+	res = callAuth(t, clientConn, 3, "Echo.Ping", "a")
+	rpcErr := res.RPCError()
+	if rpcErr == nil || rpcErr.Code != protocol.Err_Code_Resource_Exhausted {
+		t.Fatal("second call of a must be resource exhausted")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+
+	tb := NewTokenBucket(1, 1)
+	if !tb.Allow("a") || tb.Allow("a") {
+		t.Fatal("bucket must hold burst tokens")
+	}
+	tb.mutex.Lock()
+	tb.buckets["a"].time = tb.buckets["a"].time.Add(-time.Second)
+	tb.mutex.Unlock()
+	if !tb.Allow("a") {
+		t.Fatal("bucket must refill")
+	}
+}
+
+func TestTokenBucketEvict(t *testing.T) {
+
+	tb := NewTokenBucket(1, 2)
+	tb.Allow("a")
+	tb.Allow("b")
+	tb.Allow("b")
+	tb.mutex.Lock()
+	// a is refilled to burst, b is not
+	tb.buckets["a"].time = tb.buckets["a"].time.Add(-time.Second)
+	tb.swept = tb.swept.Add(-2 * time.Second)
+	tb.mutex.Unlock()
+	tb.Allow("c")
+	if _, ok := tb.buckets["a"]; ok || len(tb.buckets) != 2 {
+		t.Fatal("idle bucket refilled to burst must be evicted")
+	}
+}
+
+func TestCallerKey(t *testing.T) {
+
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324}
+	ctx := context.WithValue(context.Background(), remoteAddrKey{}, addr)
+	if callerKey(ctx) != "203.0.113.7" {
+		t.Fatal("calls must be keyed by the remote host")
+	}
+	ctx = context.WithValue(context.Background(), remoteAddrKey{}, streamAddr("pipe"))
+	if callerKey(ctx) != "pipe" {
+		t.Fatal("address without port must be the key")
+	}
+}
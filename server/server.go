@@ -3,32 +3,186 @@ package server
 import (
 	"net/http"
 	"io"
-	"log"
 	"net"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"strconv"
+	"fmt"
+	"runtime/debug"
+	"crypto/tls"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/phachon/kitten/protocol"
 )
 
 type Server struct {
+	// max idle time waiting for the next request on a connection, 0 means no timeout
+	ReadTimeout time.Duration
+	// max time for writing a response, a slow client not reading the response in time is closed,
+	// 0 means no timeout
+	WriteTimeout time.Duration
+	// tcp keepalive of the served tcp connections, the idle time before the first probe and between probes,
+	// and the unanswered probes before a dead peer is dropped and its read fails. 0 means the system default
+	KeepAlive time.Duration
+	KeepAliveCount int
+	// max time of a handler, and of a request with a deadline the earlier one. a late handler gets
+	// a timeout exception response, it keeps running until it returns but its response is dropped.
+	// 0 means no timeout
+	HandlerTimeout time.Duration
+	// max concurrent connections, new connections over the limit are rejected, 0 means no limit
+	MaxConns int
+	// read the PROXY protocol v1 header of a load balancer off the front of every connection of Serve and ServeConn,
+	// the source address is the remote address of the requests. a connection without a valid header is closed.
+	// the http connections use the remote address of the http request
+	ProxyProtocol bool
+	// max time a connection finishes its in-flight requests after Shutdown, then it is closed and
+	// the late responses are dropped. 0 means the connection waits for all its requests
+	ShutdownGrace time.Duration
+	// logger of the server, nil means the standard logger
+	Logger Logger
+	// stats handler of the requests, nil means no stats
+	StatsHandler StatsHandler
+	// access log of every served request including heartbeats, called after the response is written,
+	// nil means no access log
+	AccessLog func(entry *AccessEntry)
+	// response payload shorter than it is written uncompressed, default protocol.Default_Compress_Threshold
+	CompressThreshold int
+	// compress type of the responses if the client accepts it, otherwise the responses are uncompressed.
+	// Compress_Type_None means the compress type of the request
+	CompressType byte
+	// gzip level of the gzip compressed responses, it replaces the level of the registered protocol.GzipCompressor.
+	// NewServer sets gzip.DefaultCompression, 0 is gzip.NoCompression
+	GzipLevel int
+	// serialize types of the served requests, a request of another type gets a protocol.Err_Code_Unsupported
+	// exception before its payload is decoded. nil means any type
+	SerializeTypes []byte
+	// hmac key shared with the clients, requests without a valid hmac close the connection,
+	// responses carry the hmac. nil means no hmac
+	AuthKey []byte
+	// byte order of the seq and lengths of the requests and responses, nil means binary.BigEndian
+	ByteOrder binary.ByteOrder
+	// magic number of the requests and responses, requests with another magic close the connection,
+	// 0 means protocol.MagicNumber
+	MagicNumber byte
 
+	connSemOnce sync.Once
+	connSem chan struct{}
+
+	handlerLock sync.RWMutex
+	handlers map[string]Handler
+	methods map[string]*methodType
+	interceptors []Interceptor
+	// wire method aliases of the methods
+	aliases map[string]string
+	// concurrency and payload limits of the methods
+	limits map[string]*concurrencyLimit
+	payloadLimits map[string]payloadLimit
+	// call stats of the debug page
+	debugStats debugStats
+
+	// protect following, track active connections and listeners for shutdown
+	connLock sync.Mutex
+	activeConn map[net.Conn]struct{}
+	listeners map[net.Listener]struct{}
+	connWg sync.WaitGroup
+	inShutdown bool
 }
 
+// Handler handle the request message and fill the response message,
+// ctx carries the deadline of the request
+type Handler func(ctx context.Context, req *protocol.Message, res *protocol.Message) error
+
 const (
 	Http_Path_Rpc = "/_kittenRpc_"
 	Http_Path_Debug = "/debug/kittenRpc"
 )
 
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		handlers: make(map[string]Handler),
+		methods: make(map[string]*methodType),
+		activeConn: make(map[net.Conn]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+		CompressThreshold: protocol.Default_Compress_Threshold,
+		GzipLevel: gzip.DefaultCompression,
+	}
 }
 
-// handle http
+// handle http, the rpc path requires CONNECT, the debug path serves GET
+// and Http_Path_Stream serves the POST streams of ServeHTTP2
 func (server *Server) HandleHttp(rpcPath string, debugPath string) {
 	http.Handle(rpcPath, server)
-	http.Handle(debugPath, server)
+	http.Handle(debugPath, http.HandlerFunc(server.serveDebug))
+	http.Handle(Http_Path_Stream, http.HandlerFunc(server.ServeHTTP2))
+}
+
+// ServeTLS accepts TLS connections on the listener and serves the default rpc, debug and stream
+// http paths, hijacked rpc connections are the negotiated *tls.Conn.
+// h2 is advertised for the streams of ServeHTTP2, a CONNECT of the rpc path must be http/1.1
+// because an HTTP/2 stream can't be hijacked. config must not be nil
+func (server *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	if config == nil {
+		return errors.New("rpc: ServeTLS requires a tls config")
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Http_Path_Rpc, server)
+	mux.Handle(Http_Path_Debug, http.HandlerFunc(server.serveDebug))
+	mux.Handle(Http_Path_Stream, http.HandlerFunc(server.ServeHTTP2))
+
+	config = config.Clone()
+	config.NextProtos = []string{"h2", "http/1.1"}
+	httpServer := &http.Server{
+		Handler: mux,
+	}
+	return httpServer.Serve(tls.NewListener(l, config))
+}
+
+// max wait before accepting again after a temporary accept error
+const Max_Accept_Delay = time.Second
+
+// ErrServerClosed is returned by Serve after Shutdown
+var ErrServerClosed = errors.New("rpc: server closed")
+
+// Serve accepts connections on the listener and serves each by ServeConn in its own goroutine,
+// without the http layer. temporary accept errors are retried with backoff,
+// Serve returns the first other accept error, or ErrServerClosed after Shutdown closed the listener
+func (server *Server) Serve(l net.Listener) error {
+	if !server.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer server.trackListener(l, false)
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if server.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				}else {
+					delay *= 2
+				}
+				if delay > Max_Accept_Delay {
+					delay = Max_Accept_Delay
+				}
+				server.logger().Warnf("rpc accept error: %s, retrying in %s", err.Error(), delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go server.ServeConn(conn)
+	}
 }
 
 var connected = "200 Connected to Go RPC"
 
-// ServeHTTP implements an http.Handle
+// ServeHTTP implements an http.Handle of the rpc path, only CONNECT is allowed
 func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request)  {
 	if req.Method != "CONNECT" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -36,16 +190,593 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request)  {
 		io.WriteString(w, "405 must CONNECT\n")
 		return
 	}
-	conn, _, err := w.(http.Hijacker).Hijack()
+	if server.shuttingDown() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "503 server is shutting down\n")
+		return
+	}
+	if !server.acquireConn() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "503 too many connections\n")
+		return
+	}
+	defer server.releaseConn()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		// like http/2, the connection can't be taken over
+		server.logger().Errorf("rpc hijacking %s: response writer does not support hijacking", req.RemoteAddr)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "500 connection does not support hijacking, CONNECT over http/1.x\n")
+		return
+	}
+	conn, _, err := hijacker.Hijack()
 	if err != nil {
-		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		server.logger().Errorf("rpc hijacking %s: %s", req.RemoteAddr, err.Error())
 		return
 	}
 	io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
-	server.ServeConn(conn)
+	server.serveConn(conn, streamAddr(req.RemoteAddr))
+}
+
+// Handle register the handler for the method
+func (server *Server) Handle(method string, handler Handler) {
+	server.handlerLock.Lock()
+	defer server.handlerLock.Unlock()
+	server.handlers[method] = handler
 }
 
 // Serve Conn
+// read request messages until the conn is closed, every request is dispatched
+// in its own goroutine and the response is written back with the same seq.
+// the conn is closed at once if MaxConns connections are being served
 func (server *Server) ServeConn(conn net.Conn) {
+	if !server.acquireConn() {
+		conn.Close()
+		return
+	}
+	defer server.releaseConn()
+	server.serveConn(conn, nil)
+}
+
+// serve the conn, the connection limit is acquired. remoteAddr is the remote address of the http
+// request of the conn, nil for a raw connection which carries the PROXY protocol header if it is enabled
+func (server *Server) serveConn(conn net.Conn, remoteAddr net.Addr) {
+	defer conn.Close()
+	if !server.trackConn(conn, true) {
+		return
+	}
+	defer server.trackConn(conn, false)
+	server.setKeepAlive(conn)
+
+	c := &connection{
+		server: server,
+		conn: protocol.NewConn(conn),
+		remoteAddr: remoteAddr,
+	}
+	if remoteAddr == nil {
+		c.remoteAddr = conn.RemoteAddr()
+		if server.ProxyProtocol && !c.readProxyHeader() {
+			return
+		}
+	}
+	var wg sync.WaitGroup
+	r := &countingReader{r: c.conn}
+	// only the first message may be the version handshake
+	first := true
+	for {
+		if server.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(server.ReadTimeout))
+		}
+		// check after the deadline is set, the deadline of shutdown is not overwritten
+		if server.shuttingDown() {
+			break
+		}
+		r.n = 0
+		req, err := protocol.ReadMessageOptions(r, protocol.ReadOptions{
+			AuthKey: server.AuthKey,
+			ByteOrder: server.ByteOrder,
+			MagicNumber: server.MagicNumber,
+			PayloadLimit: server.requestPayloadLimit,
+		})
+		if err == protocol.ErrPayloadTooLarge {
+			// the payload is discarded, the connection is still usable
+			first = false
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.rejectPayload(req)
+			}()
+			continue
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && r.n == 0 {
+				// idle connection, close cleanly
+				break
+			}
+			if err != io.EOF && !server.shuttingDown() {
+				server.logger().Errorf("rpc read message %s: %s", conn.RemoteAddr(), err.Error())
+			}
+			break
+		}
+		handshake := first && isHandshake(req)
+		first = false
+		if handshake {
+			// answered in order, the client waits for the version before sending requests
+			if !c.handshake(req) {
+				break
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(bytesIn int) {
+			defer wg.Done()
+			c.serveRequest(req, bytesIn)
+		}(r.n)
+	}
+	server.drain(conn, &wg)
+}
+
+// wait for the in-flight requests of the conn, on shutdown for ShutdownGrace at most,
+// the late handlers keep running and their responses fail to write to the closed conn
+func (server *Server) drain(conn net.Conn, wg *sync.WaitGroup) {
+	if server.ShutdownGrace <= 0 || !server.shuttingDown() {
+		wg.Wait()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(server.ShutdownGrace)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		server.logger().Warnf("rpc shutdown %s: closed with in-flight requests after %s", conn.RemoteAddr(), server.ShutdownGrace)
+	}
+}
+
+// served connection
+type connection struct {
+	server *Server
+	conn *protocol.Conn
+	// remote address of the requests, the source address of the PROXY protocol header
+	remoteAddr net.Addr
+	// lock writing response
+	sending sync.Mutex
+}
+
+// serve the request read from the connection, bytesIn is the frame size of the request
+func (c *connection) serveRequest(req *protocol.Message, bytesIn int) {
+	server := c.server
+
+	start := time.Now()
+	if req.Header.IsHeartBeat() || req.Method() == protocol.Method_Ping {
+		// heartbeat and ping are not dispatched, one way heartbeat has no response
+		res := heartbeat(req)
+		if !req.Header.IsOneWay() {
+			c.writeResponse(res)
+		}
+		c.accessLog(req, res, start)
+		return
+	}
+
+	stats := &RequestStats{
+		Method: req.Method(),
+		Seq: req.Header.Seq(),
+		RemoteAddr: c.remoteAddr.String(),
+		OneWay: req.Header.IsOneWay(),
+		BytesIn: bytesIn,
+		Start: start,
+	}
+	statsHandler := server.statsHandler()
+	statsHandler.RequestStart(stats)
+
+	res, err := server.dispatch(req, c.remoteAddr)
+	stats.Error = err
+	// one way request has no response, even on error
+	if !req.Header.IsOneWay() {
+		stats.BytesOut, _ = c.writeResponse(res)
+	}
+	c.accessLog(req, res, start)
+
+	stats.Duration = time.Since(stats.Start)
+	if server.registered(stats.Method) {
+		server.debugStats.record(stats.Method, err, stats.Duration)
+	}
+	statsHandler.RequestEnd(stats)
+}
+
+// write the response, return the bytes written
+func (c *connection) writeResponse(res *protocol.Message) (int, error) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+
+	if c.server.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+	}
+	res.SetAuthKey(c.server.AuthKey)
+	res.SetByteOrder(c.server.ByteOrder)
+	if c.server.MagicNumber != 0 {
+		res.Header.SetMagicNumber(c.server.MagicNumber)
+	}
+	n, err := c.conn.WriteMessage(res)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// the frame is partially written, the connection can't be used
+		c.server.logger().Errorf("rpc write response %s: timeout after %s, closing the connection", c.conn.RemoteAddr(), c.server.WriteTimeout)
+		c.conn.Close()
+	}else if err != nil {
+		c.server.logger().Errorf("rpc write response %s: %s", c.conn.RemoteAddr(), err.Error())
+	}
+	return int(n), err
+}
+
+// Shutdown gracefully shuts down the server, the listeners of Serve are closed and new connections are refused,
+// active connections stop reading new requests and exit after the in-flight requests are answered,
+// or are closed after ShutdownGrace. Shutdown waits for the connections to exit until the context is done
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.connLock.Lock()
+	server.inShutdown = true
+	for l := range server.listeners {
+		l.Close()
+	}
+	for conn := range server.activeConn {
+		// interrupt the blocked read of the next request
+		conn.SetReadDeadline(time.Now())
+	}
+	server.connLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.connWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// conn of which the tcp keepalive can be set, like *net.TCPConn
+type keepAliveConn interface {
+	SetKeepAliveConfig(config net.KeepAliveConfig) error
+}
+
+// enable tcp keepalive of a tcp or tls over tcp conn if it is configured
+func (server *Server) setKeepAlive(conn net.Conn) {
+	if server.KeepAlive == 0 && server.KeepAliveCount == 0 {
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	kaConn, ok := conn.(keepAliveConn)
+	if !ok {
+		return
+	}
+	err := kaConn.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable: true,
+		Idle: server.KeepAlive,
+		Interval: server.KeepAlive,
+		Count: server.KeepAliveCount,
+	})
+	if err != nil {
+		server.logger().Warnf("rpc set keepalive %s: %s", conn.RemoteAddr(), err.Error())
+	}
+}
+
+// acquire a connection of the MaxConns limit, return false if the limit is reached
+func (server *Server) acquireConn() bool {
+	server.connSemOnce.Do(func() {
+		if server.MaxConns > 0 {
+			server.connSem = make(chan struct{}, server.MaxConns)
+		}
+	})
+	if server.connSem == nil {
+		return true
+	}
+	select {
+	case server.connSem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release the acquired connection
+func (server *Server) releaseConn() {
+	if server.connSem != nil {
+		<-server.connSem
+	}
+}
+
+// is server shutting down
+func (server *Server) shuttingDown() bool {
+	server.connLock.Lock()
+	defer server.connLock.Unlock()
+	return server.inShutdown
+}
+
+// add or remove the active connection, return false if the server is shutting down
+func (server *Server) trackConn(conn net.Conn, add bool) bool {
+	server.connLock.Lock()
+	defer server.connLock.Unlock()
+	if add {
+		if server.inShutdown {
+			return false
+		}
+		server.activeConn[conn] = struct{}{}
+		server.connWg.Add(1)
+	}else {
+		delete(server.activeConn, conn)
+		server.connWg.Done()
+	}
+	return true
+}
+
+// track the listener of Serve, adding fails if the server is shutting down
+func (server *Server) trackListener(l net.Listener, add bool) bool {
+	server.connLock.Lock()
+	defer server.connLock.Unlock()
+	if add {
+		if server.inShutdown {
+			return false
+		}
+		server.listeners[l] = struct{}{}
+	}else {
+		delete(server.listeners, l)
+	}
+	return true
+}
+
+// count the bytes read, to tell an idle timeout from a timeout in the middle of a frame
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// heartbeat response of the heartbeat or ping request, OK with the server time
+func heartbeat(req *protocol.Message) *protocol.Message {
+	res := protocol.NewMessage()
+	res.Header.SetVersion(req.Header.Version())
+	res.Header.SetMessageType(protocol.Message_Type_Response)
+	res.Header.SetHeartBeat(true)
+	res.Header.SetSeq(req.Header.Seq())
+	if method := req.Method(); method != "" {
+		res.SetMethod(method)
+	}
+	res.MetaData[protocol.Meta_Time] = strconv.FormatInt(time.Now().UnixNano(), 10)
+	res.SetPayload([]byte("OK"))
+	return res
+}
+
+// dispatch the request of the remote address to the handler of the method, return response message and the handler error.
+// remoteAddr is nil if unknown
+func (server *Server) dispatch(req *protocol.Message, remoteAddr net.Addr) (*protocol.Message, error) {
+	res := server.response(req)
+
+	server.handlerLock.RLock()
+	method := server.methodName(req.Method())
+	handler, ok := server.handlers[method]
+	mType, registered := server.methods[method]
+	server.handlerLock.RUnlock()
+
+	ctx, cancel, err := requestContext(req, remoteAddr)
+	if err == nil {
+		defer cancel()
+		if server.HandlerTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, server.HandlerTimeout)
+			defer cancel()
+		}
+		var call func(res *protocol.Message) error
+		if ok {
+			call = func(res *protocol.Message) error {
+				return server.callHandler(ctx, method, handler, req, res)
+			}
+		}else if registered {
+			call = func(res *protocol.Message) error {
+				return server.callMethod(ctx, method, mType, req, res)
+			}
+		}
+
+		var release func()
+		if ctx.Err() != nil {
+			// deadline passed before the request is handled
+			err = ctx.Err()
+		}else if !server.serializeAllowed(req.Header.SerializeType()) {
+			server.logger().Warnf("rpc method %s: serialize type %d is not allowed", method, req.Header.SerializeType())
+			err = protocol.NewRPCError(protocol.Err_Code_Unsupported, "rpc: serialize type " + strconv.Itoa(int(req.Header.SerializeType())) + " is not supported")
+		}else if call == nil {
+			server.logger().Warnf("rpc can't find method %s", method)
+			err = protocol.NewRPCError(protocol.Err_Code_Method_Not_Found, "rpc: can't find method " + method)
+		}else if release, err = server.acquireCall(ctx, method); err != nil {
+			server.logger().Warnf("rpc method %s: %s", method, err.Error())
+		}else {
+			res, err = server.callTimeout(ctx, method, res, func(res *protocol.Message) error {
+				// the call is counted until it returns, even after the timeout
+				defer release()
+				return call(res)
+			})
+		}
+		if limit := server.payloadLimit(method).response; err == nil && limit > 0 && uint32(len(res.Payload)) > limit {
+			res = server.response(req)
+			err = protocol.NewRPCError(protocol.Err_Code_Payload_Too_Large, "rpc: response payload of method " + method + " is too large")
+			server.logger().Warnf("rpc method %s: response payload too large", method)
+		}
+	}
+
+	if err != nil {
+		setError(res, err)
+	}
+	return res, err
+}
+
+// is the serialize type in SerializeTypes
+func (server *Server) serializeAllowed(serializeType byte) bool {
+	if server.SerializeTypes == nil {
+		return true
+	}
+	for _, t := range server.SerializeTypes {
+		if t == serializeType {
+			return true
+		}
+	}
+	return false
+}
+
+// response message of the request, uncompressed. the method is echoed so the client
+// can tell a late response of a recycled seq from the response of its call
+func newResponse(req *protocol.Message) *protocol.Message {
+	res := protocol.NewMessage()
+	res.Header.SetVersion(req.Header.Version())
+	res.Header.SetMessageType(protocol.Message_Type_Response)
+	res.Header.SetSerializeType(req.Header.SerializeType())
+	res.Header.SetSeq(req.Header.Seq())
+	if method := req.Method(); method != "" {
+		res.SetMethod(method)
+	}
+	return res
+}
+
+// response message of the dispatched request, compressed by the compress type the client accepts
+func (server *Server) response(req *protocol.Message) *protocol.Message {
+	res := newResponse(req)
+	compressType := server.CompressType
+	if compressType == protocol.Compress_Type_None {
+		compressType = req.Header.CompressType()
+	}
+	if req.AcceptCompress(compressType) {
+		res.Header.SetCompressType(compressType)
+	}
+	res.SetCompressThreshold(server.CompressThreshold)
+	res.SetGzipLevel(server.GzipLevel)
+	return res
+}
+
+// set the exception of the error in the response, with the code of an RPCError
+func setError(res *protocol.Message, err error) {
+	res.Header.SetMessageStatusType(protocol.Message_Status_Exception)
+	res.SetPayload([]byte(err.Error()))
+	var rpcErr *protocol.RPCError
+	if errors.As(err, &rpcErr) {
+		res.SetRPCError(rpcErr)
+	}
+}
+
+// call fn with the response, fn runs in its own goroutine if ctx has a deadline and a new
+// response is returned with the timeout error when ctx is done first, fn may still be running
+func (server *Server) callTimeout(ctx context.Context, method string, res *protocol.Message,
+	fn func(res *protocol.Message) error) (*protocol.Message, error) {
+
+	if _, ok := ctx.Deadline(); !ok {
+		return res, server.recoverCall(method, func() error {
+			return fn(res)
+		})
+	}
+
+	// the late fn writes the abandoned response
+	timeoutRes := res.Clone()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.recoverCall(method, func() error {
+			return fn(res)
+		})
+	}()
+	select {
+	case err := <-done:
+		return res, err
+	case <-ctx.Done():
+		return timeoutRes, fmt.Errorf("rpc: method %s: %v", method, ctx.Err())
+	}
+}
+
+// call fn and recover the panic to an error, the connection keeps serving
+func (server *Server) recoverCall(method string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.logger().Errorf("rpc method %s panic: %v\n%s", method, r, debug.Stack())
+			err = fmt.Errorf("rpc: method %s panic: %v", method, r)
+		}
+	}()
+	return fn()
+}
+
+// context of the request, with the request message, the trace, the remote address and the deadline of the request meta
+func requestContext(req *protocol.Message, remoteAddr net.Addr) (context.Context, context.CancelFunc, error) {
+	parent := context.WithValue(context.Background(), requestKey{}, req)
+	if trace, ok := req.Trace(); ok {
+		parent = protocol.ContextWithTrace(parent, trace)
+	}
+	if remoteAddr != nil {
+		parent = context.WithValue(parent, remoteAddrKey{}, remoteAddr)
+	}
+	deadline, ok := req.MetaData[protocol.Meta_Deadline]
+	if !ok {
+		ctx, cancel := context.WithCancel(parent)
+		return ctx, cancel, nil
+	}
+	nano, err := strconv.ParseInt(deadline, 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("rpc: invalid deadline " + deadline)
+	}
+	ctx, cancel := context.WithDeadline(parent, time.Unix(0, nano))
+	return ctx, cancel, nil
+}
 
-}
\ No newline at end of file
+// context keys of the request message, the remote address and the response message
+type requestKey struct{}
+type remoteAddrKey struct{}
+type responseKey struct{}
+
+// RequestFromContext returns the request message of the handler or interceptor context, nil if none.
+// the message must not be modified
+func RequestFromContext(ctx context.Context) *protocol.Message {
+	req, _ := ctx.Value(requestKey{}).(*protocol.Message)
+	return req
+}
+
+// SetResponseMeta set the meta of the response of the handler context, like res.MetaData of a Handler
+// for methods of Register with a context argument. false if the context has no response
+func SetResponseMeta(ctx context.Context, key string, value string) bool {
+	res, ok := ctx.Value(responseKey{}).(*protocol.Message)
+	if ok {
+		res.MetaData[key] = value
+	}
+	return ok
+}
+
+// SetResponseCompress set the compress type of the response of the handler context over the server
+// CompressType, like res.Header.SetCompressType of a Handler. protocol.Compress_Type_None writes an already
+// compressed payload as is, another type the client doesn't accept is ignored. false if the context has no response
+func SetResponseCompress(ctx context.Context, compressType byte) bool {
+	res, ok := ctx.Value(responseKey{}).(*protocol.Message)
+	if !ok {
+		return false
+	}
+	if req := RequestFromContext(ctx); compressType == protocol.Compress_Type_None || req != nil && req.AcceptCompress(compressType) {
+		res.Header.SetCompressType(compressType)
+	}
+	return true
+}
+
+// RemoteAddrFromContext returns the remote address of the request of the handler or interceptor context,
+// nil if unknown like requests of ServeCodec
+func RemoteAddrFromContext(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(remoteAddrKey{}).(net.Addr)
+	return addr
+}
@@ -0,0 +1,974 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"strings"
+	"errors"
+	"time"
+	"io"
+	"context"
+	"sync"
+	"bytes"
+	"fmt"
+	"bufio"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"github.com/phachon/kitten/protocol"
+)
+
+// write a request of the method and read the response
+func call(t *testing.T, conn net.Conn, seq uint64, method string, payload []byte) *protocol.Message {
+	req := protocol.NewMessage()
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.Header.SetSeq(seq)
+	req.SetMetaData(map[string]string{protocol.Meta_Method: method})
+	req.SetPayload(payload)
+
+	_, err := req.WriteTo(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := protocol.ReadMessage(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return res
+}
+
+func TestServeConn(t *testing.T) {
+
+	server := NewServer()
+	server.Handle("Echo.Upper", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload([]byte(strings.ToUpper(string(req.Payload))))
+		return nil
+	})
+	server.Handle("Echo.Fail", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		return errors.New("echo fail")
+	})
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.ServeConn(serverConn)
+		close(done)
+	}()
+
+	res := call(t, clientConn, 10, "Echo.Upper", []byte("kitten"))
+	if res.Header.MessageType() != protocol.Message_Type_Response {
+		t.Fatal("message type is not response")
+	}
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal("message status is not normal")
+	}
+	if res.Header.Seq() != 10 {
+		t.Fatal("response seq error")
+	}
+	if string(res.Payload) != "KITTEN" {
+		t.Fatal("response payload error")
+	}
+
+	res = call(t, clientConn, 11, "Echo.Fail", []byte("kitten"))
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception {
+		t.Fatal("handler error must be exception")
+	}
+	if string(res.Payload) != "echo fail" {
+		t.Fatal("exception payload error")
+	}
+
+	res = call(t, clientConn, 12, "Echo.Lower", []byte("kitten"))
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception {
+		t.Fatal("unknown method must be exception")
+	}
+	if res.Header.Seq() != 12 {
+		t.Fatal("response seq error")
+	}
+
+	clientConn.Close()
+	<-done
+}
+
+// listener returning a temporary error before accepting
+type temporaryListener struct {
+	net.Listener
+	errs int
+}
+
+type temporaryError struct{}
+
+func (e temporaryError) Error() string { return "temporary error" }
+func (e temporaryError) Timeout() bool { return false }
+func (e temporaryError) Temporary() bool { return true }
+
+func (l *temporaryListener) Accept() (net.Conn, error) {
+	if l.errs > 0 {
+		l.errs--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServe(t *testing.T) {
+
+	server := NewServer()
+	logger := &captureLogger{}
+	server.Logger = logger
+	server.Handle("Echo.Upper", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload([]byte(strings.ToUpper(string(req.Payload))))
+		return nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(&temporaryListener{Listener: l, errs: 2})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	res := call(t, conn, 1, "Echo.Upper", []byte("kitten"))
+	if string(res.Payload) != "KITTEN" {
+		t.Fatal("response payload error")
+	}
+
+	l.Close()
+	if <-done == nil {
+		t.Fatal("closed listener must return error")
+	}
+	if strings.Count(logger.String(), "retrying") != 2 {
+		t.Fatal("temporary accept errors must be retried")
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+
+	server := NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	// the served connection tells Serve is accepting
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	res := call(t, conn, 1, protocol.Method_Ping, nil)
+	if res.Header.Seq() != 1 {
+		t.Fatal("ping response error")
+	}
+	conn.Close()
+
+	err = server.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if <-done != ErrServerClosed {
+		t.Fatal("Serve must return ErrServerClosed after Shutdown")
+	}
+	_, err = net.Dial("tcp", l.Addr().String())
+	if err == nil {
+		t.Fatal("listener must be closed by Shutdown")
+	}
+	if server.Serve(l) != ErrServerClosed {
+		t.Fatal("Serve after Shutdown must return ErrServerClosed")
+	}
+}
+
+func TestMethodNotFound(t *testing.T) {
+
+	server := NewServer()
+	logger := &captureLogger{}
+	server.Logger = logger
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	for seq := uint64(1); seq <= 2; seq++ {
+		res := call(t, clientConn, seq, "Echo.Unknown", nil)
+		if res.Header.MessageStatusType() != protocol.Message_Status_Exception || res.Header.Seq() != seq {
+			t.Fatal("unknown method must be exception")
+		}
+		rpcErr := res.RPCError()
+		if rpcErr == nil || rpcErr.Code != protocol.Err_Code_Method_Not_Found || !strings.Contains(rpcErr.Message, "Echo.Unknown") {
+			t.Fatal("unknown method must be method not found error")
+		}
+	}
+	if !strings.Contains(logger.String(), "WARN rpc can't find method Echo.Unknown") {
+		t.Fatal("unknown method must be logged at warn level")
+	}
+}
+
+func TestSerializeTypes(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+	server.SerializeTypes = []byte{protocol.Serialize_Json}
+	called := 0
+	server.Handle("Echo.Echo", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		called++
+		return nil
+	})
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	for i, serializeType := range []byte{protocol.Serialize_Json, protocol.Serialize_Gob} {
+		req := protocol.NewMessage()
+		req.Header.SetMessageType(protocol.Message_Type_Request)
+		req.Header.SetSeq(uint64(i + 1))
+		req.Header.SetSerializeType(serializeType)
+		req.SetMethod("Echo.Echo")
+		go req.WriteTo(clientConn)
+		res, err := protocol.ReadMessage(clientConn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		rpcErr := res.RPCError()
+		if serializeType == protocol.Serialize_Json && res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+			t.Fatal("allowed serialize type must be served")
+		}
+		if serializeType == protocol.Serialize_Gob && (rpcErr == nil || rpcErr.Code != protocol.Err_Code_Unsupported) {
+			t.Fatal("disallowed serialize type must be unsupported")
+		}
+	}
+	if called != 1 {
+		t.Fatal("handler must not run for a disallowed serialize type")
+	}
+}
+
+func TestSetResponseCompress(t *testing.T) {
+
+	server := NewServer()
+	server.CompressType = protocol.Compress_Type_Gzip
+	server.CompressThreshold = 0
+	server.Handle("Image.Get", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		// the image is already compressed
+		if !SetResponseCompress(ctx, protocol.Compress_Type_None) {
+			return errors.New("no response in the context")
+		}
+		res.SetPayload(req.Payload)
+		return nil
+	})
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	req := protocol.NewMessage()
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.Header.SetSeq(1)
+	req.SetMethod("Image.Get")
+	req.SetAcceptCompress(protocol.Compress_Type_None, protocol.Compress_Type_Gzip)
+	req.SetPayload(bytes.Repeat([]byte("png"), 1024))
+	go req.WriteTo(clientConn)
+
+	header, err := protocol.ReadHeader(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if header.CompressType() != protocol.Compress_Type_None {
+		t.Fatal("response compress type must be overridden by the handler")
+	}
+	res, err := protocol.ReadBody(clientConn, header)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(res.Payload, req.Payload) {
+		t.Fatal("response payload error")
+	}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+
+	server := NewServer()
+	server.CompressType = protocol.Compress_Type_Gzip
+	server.CompressThreshold = 0
+	server.Handle("Echo.Echo", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(req.Payload)
+		return nil
+	})
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	cases := []struct {
+		accept []byte
+		compressType byte
+	}{
+		// client accepting only None gets uncompressed responses
+		{[]byte{protocol.Compress_Type_None}, protocol.Compress_Type_None},
+		{[]byte{protocol.Compress_Type_None, protocol.Compress_Type_Gzip}, protocol.Compress_Type_Gzip},
+		// without the accept meta only the request compress type, None
+		{nil, protocol.Compress_Type_None},
+	}
+	for i, c := range cases {
+		req := protocol.NewMessage()
+		req.Header.SetMessageType(protocol.Message_Type_Request)
+		req.Header.SetSeq(uint64(i))
+		req.MetaData[protocol.Meta_Method] = "Echo.Echo"
+		if c.accept != nil {
+			req.SetAcceptCompress(c.accept...)
+		}
+		req.SetPayload([]byte("kitten kitten kitten"))
+		go req.WriteTo(clientConn)
+
+		header, err := protocol.ReadHeader(clientConn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if header.CompressType() != c.compressType {
+			t.Fatal("response compress type must be accepted by the client")
+		}
+		res, err := protocol.ReadBody(clientConn, header)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res.Payload) != "kitten kitten kitten" {
+			t.Fatal("response payload error")
+		}
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+
+	server := NewServer()
+	server.CompressType = protocol.Compress_Type_Gzip
+	server.GzipLevel = gzip.NoCompression
+	server.Handle("Echo.Echo", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(req.Payload)
+		return nil
+	})
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	payload := bytes.Repeat([]byte("kitten "), 1000)
+	req := protocol.NewMessage()
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.Header.SetSeq(1)
+	req.MetaData[protocol.Meta_Method] = "Echo.Echo"
+	req.SetAcceptCompress(protocol.Compress_Type_Gzip)
+	req.SetPayload(payload)
+	go req.WriteTo(clientConn)
+
+	r := bufio.NewReader(clientConn)
+	sizes, err := protocol.PeekSizes(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// stored gzip blocks are longer than the payload
+	if sizes.Payload <= uint32(len(payload)) {
+		t.Fatal("gzip level of the server must be used")
+	}
+	res, err := protocol.ReadMessage(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.CompressType() != protocol.Compress_Type_Gzip || !bytes.Equal(res.Payload, payload) {
+		t.Fatal("response payload error")
+	}
+}
+
+func TestMagicNumber(t *testing.T) {
+
+	server := NewServer()
+	server.MagicNumber = 0x09
+	logger := &captureLogger{}
+	server.Logger = logger
+	server.Handle("Echo.Upper", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload([]byte(strings.ToUpper(string(req.Payload))))
+		return nil
+	})
+
+	// default magic number frame is rejected and the connection is closed
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.ServeConn(serverConn)
+		close(done)
+	}()
+	req := protocol.NewMessage()
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.SetMetaData(map[string]string{protocol.Meta_Method: "Echo.Upper"})
+	go req.WriteTo(clientConn)
+	_, err := protocol.ReadMessage(clientConn)
+	if err != io.EOF {
+		t.Fatal("default magic number request must close the connection")
+	}
+	<-done
+	if !strings.Contains(logger.String(), protocol.ErrBadMagic.Error()) {
+		t.Fatal("bad magic number must be logged")
+	}
+
+	// configured magic number frame is served
+	serverConn, clientConn = net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+	req.Header.SetMagicNumber(0x09)
+	req.Header.SetSeq(1)
+	req.SetPayload([]byte("kitten"))
+	go req.WriteTo(clientConn)
+	res, err := protocol.ReadMessageOptions(clientConn, protocol.ReadOptions{MagicNumber: 0x09})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.MagicNumber() != 0x09 || res.Header.Seq() != 1 || string(res.Payload) != "KITTEN" {
+		t.Fatal("configured magic number response error")
+	}
+}
+
+func TestHeartBeat(t *testing.T) {
+
+	server := NewServer()
+	dispatched := false
+	server.Handle("", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		dispatched = true
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	// one way heartbeat has no response, next response is the heartbeat of seq 8
+	oneWay := protocol.NewMessage()
+	oneWay.Header.SetHeartBeat(true)
+	oneWay.Header.SetOneWay(true)
+	oneWay.Header.SetSeq(7)
+	_, err := oneWay.WriteTo(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req := protocol.NewMessage()
+	req.Header.SetHeartBeat(true)
+	req.Header.SetSeq(8)
+	_, err = req.WriteTo(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := protocol.ReadMessage(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !res.Header.IsHeartBeat() {
+		t.Fatal("response is not heartbeat")
+	}
+	if res.Header.MessageType() != protocol.Message_Type_Response {
+		t.Fatal("message type is not response")
+	}
+	if res.Header.Seq() != 8 {
+		t.Fatal("heartbeat seq error")
+	}
+	if string(res.Payload) != "OK" || res.MetaData[protocol.Meta_Time] == "" {
+		t.Fatal("heartbeat must be OK with the server time")
+	}
+
+	// the reserved ping method is answered like a heartbeat
+	res = call(t, clientConn, 9, protocol.Method_Ping, nil)
+	if !res.Header.IsHeartBeat() || res.Header.Seq() != 9 || string(res.Payload) != "OK" {
+		t.Fatal("ping must be answered like a heartbeat")
+	}
+	if dispatched {
+		t.Fatal("heartbeat must not be dispatched")
+	}
+}
+
+func TestOneWay(t *testing.T) {
+
+	server := NewServer()
+	called := make(chan string, 2)
+	server.Handle("Echo.Notify", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		called <- string(req.Payload)
+		return nil
+	})
+	server.Handle("Echo.Fail", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		called <- string(req.Payload)
+		return errors.New("echo fail")
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	for _, method := range []string{"Echo.Notify", "Echo.Fail"} {
+		req := protocol.NewMessage()
+		req.Header.SetOneWay(true)
+		req.SetMetaData(map[string]string{protocol.Meta_Method: method})
+		req.SetPayload([]byte(method))
+		_, err := req.WriteTo(clientConn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if <-called != method {
+			t.Fatal("one way handler is not called")
+		}
+	}
+
+	// nothing is written back
+	clientConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := clientConn.Read(make([]byte, 1))
+	if n != 0 {
+		t.Fatal("one way request must have no response")
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatal("read must time out")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+
+	server := NewServer()
+	started := make(chan struct{})
+	server.Handle("Echo.Slow", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		res.SetPayload(req.Payload)
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.ServeConn(serverConn)
+		close(done)
+	}()
+	defer clientConn.Close()
+
+	req := protocol.NewMessage()
+	req.Header.SetSeq(1)
+	req.SetMetaData(map[string]string{protocol.Meta_Method: "Echo.Slow"})
+	req.SetPayload([]byte("kitten"))
+	_, err := req.WriteTo(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	// in-flight request completes
+	res, err := protocol.ReadMessage(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.Seq() != 1 || string(res.Payload) != "kitten" {
+		t.Fatal("in-flight response error")
+	}
+
+	err = <-shutdown
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	<-done
+
+	// new connection is refused
+	serverConn, clientConn = net.Pipe()
+	go server.ServeConn(serverConn)
+	_, err = protocol.ReadMessage(clientConn)
+	if err != io.EOF {
+		t.Fatal("new connection must be closed after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+
+	server := NewServer()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server.Handle("Echo.Block", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	req := protocol.NewMessage()
+	req.SetMetaData(map[string]string{protocol.Meta_Method: "Echo.Block"})
+	_, err := req.WriteTo(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatal("shutdown must return context error")
+	}
+	close(release)
+}
+
+func TestShutdownGrace(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+	server.ShutdownGrace = 200 * time.Millisecond
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server.Handle("Echo.Block", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	idleServer, idleClient := net.Pipe()
+	go server.ServeConn(idleServer)
+	defer idleClient.Close()
+	busyServer, busyClient := net.Pipe()
+	go server.ServeConn(busyServer)
+	defer busyClient.Close()
+
+	go writeRequests(busyClient, "Echo.Block", 1, 1)
+	<-started
+
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	// the idle connection closes at once
+	_, err := protocol.ReadMessage(idleClient)
+	if err != io.EOF || time.Since(start) >= server.ShutdownGrace {
+		t.Fatal("idle connection must be closed promptly")
+	}
+
+	// the busy connection is closed after the grace without the response
+	_, err = protocol.ReadMessage(busyClient)
+	if err != io.EOF || time.Since(start) < server.ShutdownGrace {
+		t.Fatal("busy connection must be closed after the grace")
+	}
+	err = <-shutdown
+	if err != nil {
+		t.Fatal("shutdown must not wait for the late handler")
+	}
+}
+
+// capture the logs of the server
+type captureLogger struct {
+	lock sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *captureLogger) logf(level string, format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	fmt.Fprintf(&l.buf, level+" "+format+"\n", v...)
+}
+
+func (l *captureLogger) Infof(format string, v ...interface{}) {
+	l.logf("INFO", format, v...)
+}
+
+func (l *captureLogger) Warnf(format string, v ...interface{}) {
+	l.logf("WARN", format, v...)
+}
+
+func (l *captureLogger) Errorf(format string, v ...interface{}) {
+	l.logf("ERROR", format, v...)
+}
+
+func (l *captureLogger) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buf.String()
+}
+
+func TestReadTimeout(t *testing.T) {
+
+	logs := &captureLogger{}
+	server := NewServer()
+	server.Logger = logs
+	server.ReadTimeout = 50 * time.Millisecond
+
+	// idle connection is closed cleanly
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		server.ServeConn(serverConn)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection is not closed")
+	}
+	if time.Since(start) < server.ReadTimeout {
+		t.Fatal("idle connection is closed before timeout")
+	}
+	_, err := clientConn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("idle connection must be closed")
+	}
+	if logs.String() != "" {
+		t.Fatal("idle timeout must not be logged")
+	}
+
+	// timeout in the middle of a frame is logged
+	serverConn, clientConn = net.Pipe()
+	done = make(chan struct{})
+	go func() {
+		server.ServeConn(serverConn)
+		close(done)
+	}()
+	header := protocol.NewMessage().Header
+	_, err = clientConn.Write(header[:6])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("half frame connection is not closed")
+	}
+	if !strings.Contains(logs.String(), "rpc read message") {
+		t.Fatal("half frame timeout must be logged")
+	}
+}
+
+// conn recording the keepalive config set on it
+type keepAliveRecorder struct {
+	net.Conn
+	config chan net.KeepAliveConfig
+}
+
+func (c *keepAliveRecorder) SetKeepAliveConfig(config net.KeepAliveConfig) error {
+	c.config <- config
+	return nil
+}
+
+func TestKeepAlive(t *testing.T) {
+
+	server := NewServer()
+	server.KeepAlive = time.Second
+	server.KeepAliveCount = 2
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	conn := &keepAliveRecorder{Conn: serverConn, config: make(chan net.KeepAliveConfig, 1)}
+	go server.ServeConn(conn)
+	select {
+	case config := <-conn.config:
+		if !config.Enable || config.Idle != time.Second || config.Interval != time.Second || config.Count != 2 {
+			t.Fatal("keepalive config error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("keepalive of the tcp connection must be set")
+	}
+
+	// a real tcp connection takes the config
+	logs := &captureLogger{}
+	server.Logger = logs
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server.ServeConn(conn)
+	}()
+	tcpConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer tcpConn.Close()
+	res := call(t, tcpConn, 1, protocol.Method_Ping, nil)
+	if res.Header.Seq() != 1 {
+		t.Fatal("ping response error")
+	}
+	if strings.Contains(logs.String(), "keepalive") {
+		t.Fatal("keepalive of tcp connection must be set")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+
+	server := NewServer()
+	server.MaxConns = 2
+	server.Handle("Echo.Ping", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		return nil
+	})
+
+	// two served connections
+	clientConns := make([]net.Conn, 2)
+	for i := range clientConns {
+		serverConn, clientConn := net.Pipe()
+		go server.ServeConn(serverConn)
+		clientConns[i] = clientConn
+		res := call(t, clientConn, uint64(i), "Echo.Ping", nil)
+		if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+			t.Fatal("served connection response error")
+		}
+	}
+
+	// third connection is rejected
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	_, err := protocol.ReadMessage(clientConn)
+	if err != io.EOF {
+		t.Fatal("connection over the limit must be closed")
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("CONNECT", Http_Path_Rpc, nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatal("http connection over the limit must be 503")
+	}
+
+	// released connection makes room
+	clientConns[0].Close()
+	for i := 0; len(server.connSem) == server.MaxConns && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	serverConn, clientConn = net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+	res := call(t, clientConn, 3, "Echo.Ping", nil)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal("served connection response error")
+	}
+	clientConns[1].Close()
+}
+
+// response writer which fails to hijack
+type hijackFailWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w hijackFailWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("hijack fail")
+}
+
+func TestWriteTimeout(t *testing.T) {
+
+	logs := &captureLogger{}
+	server := NewServer()
+	server.Logger = logs
+	server.WriteTimeout = 100 * time.Millisecond
+	server.Handle("File.Get", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(bytes.Repeat([]byte("k"), 1 << 20))
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.ServeConn(serverConn)
+		close(done)
+	}()
+	defer clientConn.Close()
+
+	// the client reads a few bytes slowly and never the whole response
+	start := time.Now()
+	clientConn.SetReadDeadline(start.Add(time.Second))
+	go writeRequests(clientConn, "File.Get", 1, 1)
+	buf := make([]byte, 16)
+	var err error
+	for err == nil {
+		_, err = clientConn.Read(buf)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != io.EOF || time.Since(start) < server.WriteTimeout {
+		t.Fatal("slow client must be closed after the write timeout")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection of the abandoned write must exit")
+	}
+	if !strings.Contains(logs.String(), "timeout after 100ms, closing the connection") {
+		t.Fatal("abandoned write must be logged")
+	}
+}
+
+func TestServeHTTPNoHijacker(t *testing.T) {
+
+	server := NewServer()
+	server.Logger = &captureLogger{}
+
+	// the recorder does not implement http.Hijacker
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("CONNECT", Http_Path_Rpc, nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "hijacking") {
+		t.Fatal("response writer without hijacking must be 500")
+	}
+}
+
+func TestLogger(t *testing.T) {
+
+	logs := &captureLogger{}
+	server := NewServer()
+	server.Logger = logs
+
+	req := httptest.NewRequest("CONNECT", Http_Path_Rpc, nil)
+	server.ServeHTTP(hijackFailWriter{httptest.NewRecorder()}, req)
+	if !strings.Contains(logs.String(), "ERROR rpc hijacking "+req.RemoteAddr+": hijack fail") {
+		t.Fatal("hijack failure must be logged through the logger")
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+
+	logs := &captureLogger{}
+	server := NewServer()
+	server.Logger = logs
+	server.Handle("Echo.Panic", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		panic("echo panic")
+	})
+	server.Handle("Echo.Ok", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(req.Payload)
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	res := call(t, clientConn, 1, "Echo.Panic", nil)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception {
+		t.Fatal("panic must be exception")
+	}
+	if !strings.Contains(string(res.Payload), "echo panic") {
+		t.Fatal("exception must carry the panic message")
+	}
+	if !strings.Contains(logs.String(), "ERROR rpc method Echo.Panic panic: echo panic") {
+		t.Fatal("panic must be logged")
+	}
+
+	// connection is still alive
+	res = call(t, clientConn, 2, "Echo.Ok", []byte("kitten"))
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal || string(res.Payload) != "kitten" {
+		t.Fatal("follow-up call error")
+	}
+}
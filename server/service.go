@@ -0,0 +1,208 @@
+package server
+
+import (
+	"reflect"
+	"context"
+	"errors"
+	"unicode"
+	"unicode/utf8"
+	"github.com/phachon/kitten/protocol"
+)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// registered method of service
+type methodType struct {
+	method reflect.Method
+	rcvr reflect.Value
+	// first arg is context.Context
+	hasContext bool
+	ArgType reflect.Type
+	ReplyType reflect.Type
+}
+
+// Register publish the receiver's exported methods with signature
+// func (t *T) Method(args T1, reply *T2) error
+// or func (t *T) Method(ctx context.Context, args T1, reply *T2) error
+// the methods are keyed by "Type.Method"
+func (server *Server) Register(rcvr interface{}) error {
+	return server.RegisterName("", rcvr)
+}
+
+// RegisterName publish the receiver's methods like Register keyed by "name.Method",
+// empty name means the type name
+func (server *Server) RegisterName(name string, rcvr interface{}) error {
+	rcvrValue := reflect.ValueOf(rcvr)
+	rcvrType := reflect.TypeOf(rcvr)
+	if rcvrType == nil {
+		return errors.New("rpc: register nil receiver")
+	}
+	if name == "" {
+		name = reflect.Indirect(rcvrValue).Type().Name()
+		if name == "" {
+			return errors.New("rpc: no service name for type " + rcvrType.String())
+		}
+		if !isExported(name) {
+			return errors.New("rpc: type " + name + " is not exported")
+		}
+	}
+
+	methods := suitableMethods(rcvrType, rcvrValue)
+	if len(methods) == 0 {
+		return errors.New("rpc: type " + name + " has no exported methods of suitable type")
+	}
+
+	server.handlerLock.Lock()
+	defer server.handlerLock.Unlock()
+	for methodName, mType := range methods {
+		server.methods[name+"."+methodName] = mType
+	}
+	return nil
+}
+
+// Alias route the requests of the wire method alias to the method of Handle or Register,
+// like "user.login" to "UserService.Login". the alias is looked up before the method names,
+// limits of the method apply to its aliases
+func (server *Server) Alias(alias string, method string) {
+	server.handlerLock.Lock()
+	defer server.handlerLock.Unlock()
+	if server.aliases == nil {
+		server.aliases = make(map[string]string)
+	}
+	server.aliases[alias] = method
+}
+
+// method of the wire method alias, the wire method if it is no alias. the handlerLock is held
+func (server *Server) methodName(wire string) string {
+	if method, ok := server.aliases[wire]; ok {
+		return method
+	}
+	return wire
+}
+
+// suitable methods of the type
+func suitableMethods(rcvrType reflect.Type, rcvrValue reflect.Value) map[string]*methodType {
+	methods := make(map[string]*methodType)
+	for m := 0; m < rcvrType.NumMethod(); m++ {
+		method := rcvrType.Method(m)
+		mType := method.Type
+		// method must be exported
+		if method.PkgPath != "" {
+			continue
+		}
+		// method needs three ins: receiver, *args, *reply
+		// or four ins: receiver, context, *args, *reply
+		in := 1
+		hasContext := false
+		if mType.NumIn() == 4 && mType.In(1) == typeOfContext {
+			in = 2
+			hasContext = true
+		}else if mType.NumIn() != 3 {
+			continue
+		}
+		// first arg need not be a pointer
+		argType := mType.In(in)
+		if !isExportedOrBuiltinType(argType) {
+			continue
+		}
+		// second arg must be a pointer
+		replyType := mType.In(in+1)
+		if replyType.Kind() != reflect.Ptr {
+			continue
+		}
+		if !isExportedOrBuiltinType(replyType) {
+			continue
+		}
+		// method needs one out error
+		if mType.NumOut() != 1 {
+			continue
+		}
+		if mType.Out(0) != typeOfError {
+			continue
+		}
+		methods[method.Name] = &methodType{
+			method: method,
+			rcvr: rcvrValue,
+			hasContext: hasContext,
+			ArgType: argType,
+			ReplyType: replyType,
+		}
+	}
+	return methods
+}
+
+// call the method with the request payload through the interceptors, encode reply to the response payload
+func (server *Server) callMethod(ctx context.Context, method string, m *methodType, req *protocol.Message, res *protocol.Message) error {
+	codec, err := protocol.GetCodec(req.Header.SerializeType())
+	if err != nil {
+		return err
+	}
+	args, err := m.newArgs(codec, req.Payload)
+	if err != nil {
+		return err
+	}
+
+	reply, err := server.chain(method, m.invoke)(context.WithValue(ctx, responseKey{}, res), args)
+	if err != nil {
+		return err
+	}
+
+	payload, err := codec.Encode(reply)
+	if err != nil {
+		return err
+	}
+	res.SetPayload(payload)
+	return nil
+}
+
+// new args of the method decoded from the payload
+func (m *methodType) newArgs(codec protocol.Codec, data []byte) (interface{}, error) {
+	var argv reflect.Value
+	if m.ArgType.Kind() == reflect.Ptr {
+		argv = reflect.New(m.ArgType.Elem())
+	}else {
+		argv = reflect.New(m.ArgType)
+	}
+	err := codec.Decode(data, argv.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if m.ArgType.Kind() != reflect.Ptr {
+		argv = argv.Elem()
+	}
+	return argv.Interface(), nil
+}
+
+// invoke the method with the args, return the reply pointer
+func (m *methodType) invoke(ctx context.Context, args interface{}) (interface{}, error) {
+	argv := reflect.ValueOf(args)
+	replyv := reflect.New(m.ReplyType.Elem())
+	var returnValues []reflect.Value
+	if m.hasContext {
+		returnValues = m.method.Func.Call([]reflect.Value{m.rcvr, reflect.ValueOf(ctx), argv, replyv})
+	}else {
+		returnValues = m.method.Func.Call([]reflect.Value{m.rcvr, argv, replyv})
+	}
+	errInter := returnValues[0].Interface()
+	if errInter != nil {
+		return nil, errInter.(error)
+	}
+	return replyv.Interface(), nil
+}
+
+// is exported name
+func isExported(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
+// is exported or builtin type
+func isExportedOrBuiltinType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// PkgPath will be non-empty even for an exported type,
+	// so we need to check the type name as well.
+	return isExported(t.Name()) || t.PkgPath() == ""
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"encoding/json"
+	"errors"
+	"context"
+	"strconv"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+type Args struct {
+	A int
+	B int
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith int
+
+func (t *Arith) Add(args Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func (t *Arith) Mul(args *Args, reply *Reply) error {
+	reply.C = args.A * args.B
+	return nil
+}
+
+func (t *Arith) Div(args Args, reply *Reply) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	reply.C = args.A / args.B
+	return nil
+}
+
+// wrong arity
+func (t *Arith) Neg(args Args) error {
+	return nil
+}
+
+// reply is not a pointer
+func (t *Arith) Sub(args Args, reply Reply) error {
+	return nil
+}
+
+// no error return
+func (t *Arith) Max(args Args, reply *Reply) {
+}
+
+type NoMethods int
+
+func TestRegister(t *testing.T) {
+
+	server := NewServer()
+	err := server.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, name := range []string{"Arith.Add", "Arith.Mul", "Arith.Div"} {
+		if _, ok := server.methods[name]; !ok {
+			t.Fatal("method " + name + " is not registered")
+		}
+	}
+	for _, name := range []string{"Arith.Neg", "Arith.Sub", "Arith.Max"} {
+		if _, ok := server.methods[name]; ok {
+			t.Fatal("method " + name + " must be rejected")
+		}
+	}
+
+	err = server.Register(new(NoMethods))
+	if err == nil {
+		t.Fatal("type without suitable methods must return error")
+	}
+}
+
+// write a json request of the method and read the response
+func callJson(t *testing.T, conn net.Conn, seq uint64, method string, args interface{}) *protocol.Message {
+	req := protocol.NewMessage()
+	req.Header.SetMessageType(protocol.Message_Type_Request)
+	req.Header.SetSerializeType(protocol.Serialize_Json)
+	req.Header.SetSeq(seq)
+	req.SetMetaData(map[string]string{protocol.Meta_Method: method})
+	payload, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.SetPayload(payload)
+
+	_, err = req.WriteTo(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := protocol.ReadMessage(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return res
+}
+
+func TestRegisterNameAlias(t *testing.T) {
+
+	server := NewServer()
+	err := server.RegisterName("math", new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := server.methods["math.Add"]; !ok {
+		t.Fatal("method must be registered by the name")
+	}
+	if _, ok := server.methods["Arith.Add"]; ok {
+		t.Fatal("method must not be registered by the type name")
+	}
+	server.Alias("math.add", "math.Add")
+	server.Handle("Echo.Echo", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(req.Payload)
+		return nil
+	})
+	server.Alias("echo", "Echo.Echo")
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	res := callJson(t, clientConn, 1, "math.add", Args{1, 2})
+	reply := new(Reply)
+	err = json.Unmarshal(res.Payload, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 3 {
+		t.Fatal("alias must route to the registered method")
+	}
+	res = call(t, clientConn, 2, "echo", []byte("kitten"))
+	if string(res.Payload) != "kitten" || res.Method() != "echo" {
+		t.Fatal("alias must route to the handler")
+	}
+	res = call(t, clientConn, 3, "math.sub", nil)
+	rpcErr := res.RPCError()
+	if rpcErr == nil || rpcErr.Code != protocol.Err_Code_Method_Not_Found {
+		t.Fatal("unknown alias must be method not found")
+	}
+}
+
+func TestServeRegistered(t *testing.T) {
+
+	server := NewServer()
+	err := server.Register(new(Arith))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	res := callJson(t, clientConn, 1, "Arith.Mul", Args{7, 8})
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal(string(res.Payload))
+	}
+	reply := new(Reply)
+	err = json.Unmarshal(res.Payload, reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.C != 56 {
+		t.Fatal("reply error")
+	}
+
+	res = callJson(t, clientConn, 2, "Arith.Div", Args{7, 0})
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception {
+		t.Fatal("handler error must be exception")
+	}
+	if string(res.Payload) != "divide by zero" {
+		t.Fatal("exception payload error")
+	}
+}
+
+type Clock int
+
+func (c *Clock) Deadline(ctx context.Context, args int, reply *int64) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline")
+	}
+	*reply = deadline.UnixNano()
+	return nil
+}
+
+func TestRequestDeadline(t *testing.T) {
+
+	server := NewServer()
+	called := false
+	err := server.Register(new(Clock))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server.Handle("Clock.Expired", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		called = true
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	// honored deadline
+	deadline := time.Now().Add(time.Minute).UnixNano()
+	req := protocol.NewMessage()
+	req.Header.SetSerializeType(protocol.Serialize_Json)
+	req.SetMetaData(map[string]string{
+		protocol.Meta_Method: "Clock.Deadline",
+		protocol.Meta_Deadline: strconv.FormatInt(deadline, 10),
+	})
+	req.SetPayload([]byte("1"))
+	_, err = req.WriteTo(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := protocol.ReadMessage(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal {
+		t.Fatal(string(res.Payload))
+	}
+	if string(res.Payload) != strconv.FormatInt(deadline, 10) {
+		t.Fatal("handler deadline error")
+	}
+
+	// expired deadline
+	req.SetMetaData(map[string]string{
+		protocol.Meta_Method: "Clock.Expired",
+		protocol.Meta_Deadline: strconv.FormatInt(time.Now().Add(-time.Second).UnixNano(), 10),
+	})
+	_, err = req.WriteTo(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err = protocol.ReadMessage(clientConn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception {
+		t.Fatal("expired request must be exception")
+	}
+	if string(res.Payload) != context.DeadlineExceeded.Error() {
+		t.Fatal("expired request must be timeout")
+	}
+	if called {
+		t.Fatal("expired request must not be handled")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+
+	server := NewServer()
+	server.HandlerTimeout = 50 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	server.Handle("Clock.Sleep", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		<-release
+		res.SetPayload([]byte("late"))
+		return nil
+	})
+	server.Handle("Clock.Now", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload([]byte("now"))
+		return nil
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	start := time.Now()
+	res := call(t, clientConn, 1, "Clock.Sleep", nil)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Exception || res.Header.Seq() != 1 {
+		t.Fatal("late handler must be exception")
+	}
+	if string(res.Payload) != "rpc: method Clock.Sleep: "+context.DeadlineExceeded.Error() {
+		t.Fatal("late handler must be timeout")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("timeout response must not wait the handler")
+	}
+
+	res = call(t, clientConn, 2, "Clock.Now", nil)
+	if res.Header.MessageStatusType() != protocol.Message_Status_Normal || string(res.Payload) != "now" {
+		t.Fatal("handler in time must be normal")
+	}
+}
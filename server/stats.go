@@ -0,0 +1,49 @@
+package server
+
+import (
+	"time"
+)
+
+// RequestStats stats of a dispatched request
+type RequestStats struct {
+	// request method
+	Method string
+	// request seq
+	Seq uint64
+	// remote address of the connection
+	RemoteAddr string
+	// is one way request
+	OneWay bool
+	// frame size of the request
+	BytesIn int
+	// frame size of the response, 0 for one way request, set at the end
+	BytesOut int
+	// start time of the request
+	Start time.Time
+	// duration of handling and writing the request, set at the end
+	Duration time.Duration
+	// handler error, set at the end
+	Error error
+}
+
+// StatsHandler is called at the start and the end of every dispatched request,
+// heartbeats are not dispatched and not counted
+type StatsHandler interface {
+	RequestStart(stats *RequestStats)
+	RequestEnd(stats *RequestStats)
+}
+
+// no-op stats handler
+type noopStatsHandler struct{}
+
+func (h noopStatsHandler) RequestStart(stats *RequestStats) {}
+
+func (h noopStatsHandler) RequestEnd(stats *RequestStats) {}
+
+// stats handler of the server, no-op if not set
+func (server *Server) statsHandler() StatsHandler {
+	if server.StatsHandler == nil {
+		return noopStatsHandler{}
+	}
+	return server.StatsHandler
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"sync"
+	"errors"
+	"context"
+	"time"
+	"github.com/phachon/kitten/protocol"
+)
+
+// record the stats of requests
+type fakeStatsHandler struct {
+	lock sync.Mutex
+	starts []RequestStats
+	ends []RequestStats
+}
+
+func (h *fakeStatsHandler) RequestStart(stats *RequestStats) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.starts = append(h.starts, *stats)
+}
+
+func (h *fakeStatsHandler) RequestEnd(stats *RequestStats) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ends = append(h.ends, *stats)
+}
+
+func TestStatsHandler(t *testing.T) {
+
+	stats := &fakeStatsHandler{}
+	server := NewServer()
+	server.StatsHandler = stats
+	server.Handle("Echo.Ok", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(req.Payload)
+		return nil
+	})
+	server.Handle("Echo.Fail", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		return errors.New("echo fail")
+	})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer clientConn.Close()
+
+	call(t, clientConn, 1, "Echo.Ok", []byte("kitten"))
+	call(t, clientConn, 2, "Echo.Fail", []byte("kitten"))
+
+	// end is called after the response is written
+	for i := 0; i < 100; i++ {
+		stats.lock.Lock()
+		n := len(stats.ends)
+		stats.lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if len(stats.starts) != 2 || len(stats.ends) != 2 {
+		t.Fatal("start and end must be called for every request")
+	}
+
+	start, end := stats.starts[0], stats.ends[0]
+	if start.Method != "Echo.Ok" || start.Seq != 1 || start.BytesIn == 0 {
+		t.Fatal("start stats error")
+	}
+	if end.Method != "Echo.Ok" || end.Error != nil || end.BytesOut == 0 || end.Duration <= 0 {
+		t.Fatal("success end stats error")
+	}
+
+	start, end = stats.starts[1], stats.ends[1]
+	if start.Method != "Echo.Fail" || start.Seq != 2 {
+		t.Fatal("start stats error")
+	}
+	if end.Method != "Echo.Fail" || end.Error == nil || end.Error.Error() != "echo fail" {
+		t.Fatal("failure end stats error")
+	}
+}
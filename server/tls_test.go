@@ -0,0 +1,124 @@
+package server
+
+import (
+	"testing"
+	"net"
+	"io"
+	"bufio"
+	"time"
+	"math/big"
+	"net/http"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"context"
+	"github.com/phachon/kitten/protocol"
+)
+
+// self signed certificate of 127.0.0.1
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{Organization: []string{"kitten"}},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA: true,
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestServeTLS(t *testing.T) {
+
+	cert, pool := selfSignedCert(t)
+
+	server := NewServer()
+	server.Handle("Echo.Tls", func(ctx context.Context, req *protocol.Message, res *protocol.Message) error {
+		res.SetPayload(req.Payload)
+		return nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	err = server.ServeTLS(l, nil)
+	if err == nil {
+		t.Fatal("nil tls config must return error")
+	}
+	go server.ServeTLS(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "CONNECT "+Http_Path_Rpc+" HTTP/1.0\n\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.Status != connected {
+		t.Fatal("unexpected http response: " + resp.Status)
+	}
+
+	req := protocol.NewMessage()
+	req.Header.SetSeq(3)
+	req.SetMetaData(map[string]string{protocol.Meta_Method: "Echo.Tls"})
+	req.SetPayload([]byte("kitten over tls"))
+	_, err = req.WriteTo(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := protocol.ReadMessage(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Header.Seq() != 3 || string(res.Payload) != "kitten over tls" {
+		t.Fatal("response error")
+	}
+
+	// the stream path is served over h2
+	httpClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	defer httpClient.CloseIdleConnections()
+	body, w := io.Pipe()
+	defer w.Close()
+	httpReq, err := http.NewRequest("POST", "https://" + l.Addr().String() + Http_Path_Stream, body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stream, err := httpClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK || stream.ProtoMajor != 2 {
+		t.Fatal("ServeTLS must serve the stream path over h2")
+	}
+}